@@ -0,0 +1,87 @@
+package kdb
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"crypto/subtle"
+	"encoding/hex"
+	"os"
+	"strings"
+)
+
+// Authenticator verifies credentials sent by q client during handshake.
+// Returning error rejects the connection.
+type Authenticator interface {
+	Authenticate(ctx context.Context, user, password string) error
+}
+
+// AuthenticatorFunc adapts function to Authenticator
+type AuthenticatorFunc func(ctx context.Context, user, password string) error
+
+// Authenticate calls f(ctx, user, password)
+func (f AuthenticatorFunc) Authenticate(ctx context.Context, user, password string) error {
+	return f(ctx, user, password)
+}
+
+// PasswordFile authenticates against q -u/-U style file with user:password lines.
+// Password may be stored in plain text or as MD5 hex digest. Empty lines and lines starting with / are ignored.
+// File is read on every authentication so changes take effect without restart.
+func PasswordFile(path string) Authenticator {
+	return AuthenticatorFunc(func(ctx context.Context, user, password string) error {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "/") {
+				continue
+			}
+			u, p := line, ""
+			if i := strings.IndexByte(line, ':'); i >= 0 {
+				u, p = line[:i], line[i+1:]
+			}
+			if u != user {
+				continue
+			}
+			if checkPassword(p, password) {
+				return nil
+			}
+			return ErrAuthFailed
+		}
+		if err = scanner.Err(); err != nil {
+			return err
+		}
+		return ErrAuthFailed
+	})
+}
+
+// checkPassword compares password with stored plain text or MD5 hex digest.
+// Digest is never accepted as the password itself.
+func checkPassword(stored, password string) bool {
+	if isDigest(stored) {
+		sum := md5.Sum([]byte(password))
+		return subtle.ConstantTimeCompare([]byte(strings.ToLower(stored)), []byte(hex.EncodeToString(sum[:]))) == 1
+	}
+	return subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+}
+
+// isDigest reports whether s is MD5 hex digest
+func isDigest(s string) bool {
+	if len(s) != 2*md5.Size {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+type userKey struct{}
+
+// UserFromContext returns user authenticated on connection served by Server
+func UserFromContext(ctx context.Context) (string, bool) {
+	user, ok := ctx.Value(userKey{}).(string)
+	return user, ok
+}
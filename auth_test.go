@@ -0,0 +1,65 @@
+package kdb
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writePasswordFile(t *testing.T) string {
+	path := filepath.Join(t.TempDir(), "passwd")
+	// md5 "secret"
+	data := "/ users\nplain:pwd\nhashed:5ebe2294ecd0e0f08eab7690d2a6ee69\n\nempty:\n"
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestPasswordFile(t *testing.T) {
+	auth := PasswordFile(writePasswordFile(t))
+	tests := []struct {
+		user, password string
+		ok             bool
+	}{
+		{"plain", "pwd", true},
+		{"plain", "wrong", false},
+		{"hashed", "secret", true},
+		{"hashed", "5ebe2294ecd0e0f08eab7690d2a6ee69", false},
+		{"hashed", "wrong", false},
+		{"empty", "", true},
+		{"unknown", "pwd", false},
+	}
+	for _, tt := range tests {
+		err := auth.Authenticate(context.Background(), tt.user, tt.password)
+		if (err == nil) != tt.ok {
+			t.Errorf("Authentication of %s:%s returned %v", tt.user, tt.password, err)
+		}
+	}
+	if err := PasswordFile("/nonexistent").Authenticate(context.Background(), "plain", "pwd"); err == nil {
+		t.Error("Missing password file should fail")
+	}
+}
+
+func TestServerAuthenticator(t *testing.T) {
+	h := HandlerFunc(func(ctx context.Context, c *ServerConn, msgtype ReqType, data *K) (*K, error) {
+		user, _ := UserFromContext(ctx)
+		if user != c.User() {
+			t.Errorf("User in context %s differs from connection %s", user, c.User())
+		}
+		return Symbol(user), nil
+	})
+	_, port := serveTCP(t, &Server{Handler: h, Authenticator: PasswordFile(writePasswordFile(t))})
+	con, err := DialKDB("localhost", port, "hashed:secret")
+	if err != nil {
+		t.Fatal("Failed to connect:", err)
+	}
+	defer con.Close()
+	if res, err := con.Call("whoami"); err != nil || res.Data.(string) != "hashed" {
+		t.Error("Unexpected user", res, err)
+	}
+	if _, err = DialKDB("localhost", port, "hashed:wrong"); err != ErrAuthFailed {
+		t.Error("Expected authentication failure, got", err)
+	}
+}
@@ -1,15 +1,17 @@
 package kdb
 
 import (
-	"bytes"
 	"encoding/binary"
+	"errors"
+	"math"
 )
 
-// Compress b using Q IPC compression
+// Compress b using Q IPC compression. Sizes are written in byte order given by the header of b.
 func Compress(b []byte) (dst []byte) {
 	if len(b) <= 17 {
 		return b
 	}
+	order := byteOrder(b[0])
 	i := byte(0)
 	f, h0, h := byte(0), byte(0), byte(0)
 	g := false
@@ -25,7 +27,7 @@ func Compress(b []byte) (dst []byte) {
 	a := make([]int32, 256)
 	copy(dst[:4], b[:4])
 	dst[2] = 1
-	binary.LittleEndian.PutUint32(lenbuf, uint32(len(b)))
+	order.PutUint32(lenbuf, uint32(len(b)))
 	copy(dst[8:], lenbuf)
 	for ; s < t; i *= 2 {
 		if 0 == i {
@@ -76,7 +78,7 @@ func Compress(b []byte) (dst []byte) {
 		}
 	}
 	dst[c] = f
-	binary.LittleEndian.PutUint32(lenbuf, uint32(d))
+	order.PutUint32(lenbuf, uint32(d))
 	copy(dst[4:], lenbuf)
 	return dst[:d:d]
 }
@@ -88,26 +90,45 @@ func min32(a, b int32) int32 {
 	return a
 }
 
-// Uncompress byte array compressed with Q IPC compression
-func Uncompress(b []byte) (dst []byte) {
+// ErrBadCompression indicates compressed message which is truncated or inconsistent
+var ErrBadCompression = errors.New("Bad compressed data")
+
+// Uncompress byte array compressed with Q IPC compression.
+// b is little-endian message without header, so it starts with uncompressed size of the message.
+// Returned message has space for 8 byte header.
+func Uncompress(b []byte) ([]byte, error) {
+	return uncompress(b, binary.LittleEndian)
+}
+
+// uncompress b with uncompressed size in given byte order
+func uncompress(b []byte, order binary.ByteOrder) ([]byte, error) {
 	if len(b) < 4+1 {
-		return b
+		return nil, ErrBadCompression
 	}
 	n, r, f, s := int32(0), int32(0), int32(0), int32(8)
 	p := s
 	i := int16(0)
-	var usize int32
-	binary.Read(bytes.NewReader(b[0:4]), binary.LittleEndian, &usize)
-	dst = make([]byte, usize)
+	usize := int64(order.Uint32(b[0:4]))
+	// every flag byte is followed by at most 8 matches each expanding 2 bytes to at most 257 bytes
+	if usize < 8 || usize > math.MaxInt32 || usize > 8+int64(len(b))*129 {
+		return nil, ErrBadCompression
+	}
+	dst := make([]byte, usize)
 	d := int32(4)
 	aa := make([]int32, 256)
 	for int(s) < len(dst) {
 		if i == 0 {
+			if int(d) >= len(b) {
+				return nil, ErrBadCompression
+			}
 			f = 0xff & int32(b[d])
 			d++
 			i = 1
 		}
 		if (f & int32(i)) != 0 {
+			if int(d)+1 >= len(b) || int(s)+1 >= len(dst) {
+				return nil, ErrBadCompression
+			}
 			r = aa[0xff&int32(b[d])]
 			d++
 			dst[s] = dst[r]
@@ -118,10 +139,16 @@ func Uncompress(b []byte) (dst []byte) {
 			r++
 			n = 0xff & int32(b[d])
 			d++
+			if int(s+n) > len(dst) {
+				return nil, ErrBadCompression
+			}
 			for m := int32(0); m < n; m++ {
 				dst[s+m] = dst[r+m]
 			}
 		} else {
+			if int(d) >= len(b) {
+				return nil, ErrBadCompression
+			}
 			dst[s] = b[d]
 			s++
 			d++
@@ -139,5 +166,5 @@ func Uncompress(b []byte) (dst []byte) {
 			i = 0
 		}
 	}
-	return dst
+	return dst, nil
 }
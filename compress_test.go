@@ -32,13 +32,35 @@ func TestUncompress(t *testing.T) {
 	}
 	buf := new(bytes.Buffer)
 	_ = Encode(buf, ASYNC, &K{KB, NONE, true2K})
-	uc2 := Uncompress(bytes2KTrue[8:])
-	uc1 := Uncompress(buf.Bytes()[8:])
+	uc2, err2 := Uncompress(bytes2KTrue[8:])
+	uc1, err1 := Uncompress(buf.Bytes()[8:])
+	if err1 != nil || err2 != nil {
+		t.Fatal("Uncompress failed", err1, err2)
+	}
 	if !bytes.Equal(uc1, uc2) {
 		t.Errorf("Uncompress failed expected/got: \n%v\n%v\n", buf.Bytes(), bytes2KTrue)
 	}
 }
 
+func TestUncompressCorrupt(t *testing.T) {
+	b := bytes2KTrue[8:]
+	for i := 0; i < len(b); i++ {
+		if _, err := Uncompress(b[:i]); err == nil {
+			t.Errorf("Uncompressing %d truncated bytes should fail", i)
+		}
+	}
+	for i := 0; i < 1000; i++ {
+		corrupt, _ := generateRandomBytes(len(b))
+		copy(corrupt, b[:4])
+		// must not panic
+		Uncompress(corrupt)
+	}
+	huge := append([]byte{0xff, 0xff, 0xff, 0x7f}, b[4:]...)
+	if _, err := Uncompress(huge); err != ErrBadCompression {
+		t.Error("Implausible uncompressed size should be rejected, got", err)
+	}
+}
+
 func generateRandomBytes(n int) ([]byte, error) {
 	b := make([]byte, n)
 	_, err := rand.Read(b)
@@ -6,6 +6,7 @@ import (
 	"encoding/binary"
 	"errors"
 	"io"
+	"math"
 	"reflect"
 	"time"
 	"unsafe"
@@ -34,7 +35,7 @@ var typeReflect = []reflect.Type{
 	13: reflect.TypeOf([]Month{}),
 	14: reflect.TypeOf([]int32{}),
 	15: reflect.TypeOf([]float64{}),
-	16: reflect.TypeOf([]time.Duration{}),
+	16: reflect.TypeOf([]Timespan{}),
 	17: reflect.TypeOf([]int32{}),
 	18: reflect.TypeOf([]int32{}),
 	19: reflect.TypeOf([]int32{})}
@@ -53,8 +54,10 @@ func makeArray(vectype int8, veclen int) interface{} {
 		return make([]int32, veclen)
 	case 13:
 		return make([]Month, veclen)
-	case 16, 12:
+	case 12:
 		return make([]time.Duration, veclen)
+	case 16:
+		return make([]Timespan, veclen)
 	case 7:
 		return make([]int64, veclen)
 	case 8:
@@ -69,48 +72,184 @@ func makeArray(vectype int8, veclen int) interface{} {
 }
 
 func (h *ipcHeader) getByteOrder() binary.ByteOrder {
-	var order binary.ByteOrder
-	order = binary.LittleEndian
-	if h.ByteOrder == 0x00 {
-		order = binary.BigEndian
+	return byteOrder(h.ByteOrder)
+}
+
+// byteOrder returns byte order given by the first byte of message header
+func byteOrder(b byte) binary.ByteOrder {
+	if b == 0x00 {
+		return binary.BigEndian
+	}
+	return binary.LittleEndian
+}
+
+// nativeOrder is byte order of the host. Vectors in this order are decoded without copying.
+var nativeOrder = func() binary.ByteOrder {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 1 {
+		return binary.LittleEndian
 	}
-	return order
+	return binary.BigEndian
+}()
+
+// size returns message size. Reserved byte carries bits 32-39 of the size of large messages.
+func (h *ipcHeader) size() int64 {
+	return int64(h.Reserved)<<32 | int64(h.MsgSize)
 }
 
 func (h *ipcHeader) ok() bool {
-	return h.ByteOrder == 0x01 && h.RequestType < 3 && h.Compressed < 0x02 && h.MsgSize > 9
+	return h.ByteOrder < 0x02 && h.RequestType < 3 && h.Compressed < 0x02 && h.size() > 9 &&
+		(h.Compressed == 0 || h.Reserved == 0)
 }
 
+// ErrDecodeLimit indicates that message exceeds limits set by DecodeOptions
+var ErrDecodeLimit = errors.New("Message exceeds decoding limits")
+
+// DecodeOptions limits resources used to decode a message, e.g. received from untrusted client.
+// Zero value means no limit. Exceeding a limit fails decoding with ErrDecodeLimit.
+type DecodeOptions struct {
+	// MaxMessageSize limits size of message in bytes, uncompressed size for compressed messages
+	MaxMessageSize int64
+	// MaxAlloc limits approximate number of bytes allocated for decoded objects
+	MaxAlloc int64
+	// MaxDepth limits nesting of lists, dictionaries, tables and functions
+	MaxDepth int
+	// MaxVectorLength limits number of elements of a vector or list
+	MaxVectorLength int
+}
+
+// kSize is approximate size of K allocated for every decoded object
+const kSize = 48
+
 // Decode deserialises data from src in q ipc format.
+// Vector lengths are checked against message size, use DecodeOptions to set other limits.
 func Decode(src *bufio.Reader) (data *K, msgtype ReqType, e error) {
-	var header ipcHeader
-	e = binary.Read(src, binary.LittleEndian, &header)
+	return DecodeOptions{}.Decode(src)
+}
+
+// Decode deserialises data from src in q ipc format within limits of o
+func (o DecodeOptions) Decode(src *bufio.Reader) (data *K, msgtype ReqType, e error) {
+	var hb [8]byte
+	_, e = io.ReadFull(src, hb[:])
+	if e == io.EOF {
+		// connection closed between messages
+		return nil, -1, e
+	}
 	if e != nil {
 		return nil, -1, errors.New("Failed to read message header:" + e.Error())
 	}
+	header := ipcHeader{ByteOrder: hb[0], RequestType: ReqType(hb[1]), Compressed: hb[2], Reserved: hb[3]}
+	header.MsgSize = header.getByteOrder().Uint32(hb[4:])
 	if !header.ok() {
 		return nil, -1, errors.New("header is invalid")
 	}
+	var size = header.size()
+	if o.MaxMessageSize > 0 && size > o.MaxMessageSize {
+		return nil, header.RequestType, ErrDecodeLimit
+	}
 	// try to buffer entire message in one go
-	src.Peek(int(header.MsgSize - 8))
+	src.Peek(int(size - 8))
 
 	var order = header.getByteOrder()
 	if header.Compressed == 0x01 {
-		compressed := make([]byte, header.MsgSize-8)
-		_, e = io.ReadFull(src, compressed)
+		// read what was actually sent rather than trusting size in the header
+		var compressed bytes.Buffer
+		n, e := compressed.ReadFrom(io.LimitReader(src, size-8))
+		if e == nil && n < size-8 {
+			e = io.ErrUnexpectedEOF
+		}
 		if e != nil {
 			return nil, header.RequestType, errors.New("Decode:readcompressed error - " + e.Error())
 		}
-		var uncompressed = Uncompress(compressed)
+		b := compressed.Bytes()
+		if len(b) >= 4 && o.MaxMessageSize > 0 && int64(order.Uint32(b)) > o.MaxMessageSize {
+			return nil, header.RequestType, ErrDecodeLimit
+		}
+		uncompressed, e := uncompress(b, order)
+		if e != nil {
+			return nil, header.RequestType, e
+		}
 		var buf = bufio.NewReader(bytes.NewReader(uncompressed[8:]))
-		data, e = readData(buf, order)
+		d := decoder{r: buf, order: order, opts: o, size: int64(len(uncompressed))}
+		data, e = d.readData()
 		return data, header.RequestType, e
 	}
-	data, e = readData(src, order)
+	d := decoder{r: src, order: order, wide: size > largeMessageSize, opts: o, size: size}
+	data, e = d.readData()
 	return data, header.RequestType, e
 }
 
-func readData(r *bufio.Reader, order binary.ByteOrder) (kobj *K, err error) {
+// DecodeData reads single object serialised without message header, as written by EncodeData
+func DecodeData(src *bufio.Reader) (*K, error) {
+	return DecodeOptions{}.DecodeData(src)
+}
+
+// DecodeData reads single object serialised without message header within limits of o
+func (o DecodeOptions) DecodeData(src *bufio.Reader) (*K, error) {
+	return (&decoder{r: src, order: binary.LittleEndian, opts: o}).readData()
+}
+
+// decoder reads q objects from r
+type decoder struct {
+	r     *bufio.Reader
+	order binary.ByteOrder
+	// wide is set for large messages where vector lengths take 8 bytes
+	wide bool
+	opts DecodeOptions
+	// size of the message, vectors cannot be longer, 0 if unknown
+	size  int64
+	alloc int64
+	depth int
+}
+
+// reserve accounts n bytes allocated for decoded data
+func (d *decoder) reserve(n int64) error {
+	d.alloc += n
+	if d.opts.MaxAlloc > 0 && d.alloc > d.opts.MaxAlloc {
+		return ErrDecodeLimit
+	}
+	return nil
+}
+
+// readLen reads length of vector with elements taking elem bytes in the message and allocated in memory
+func (d *decoder) readLen(elem int64) (int, error) {
+	var n int64
+	if d.wide {
+		if err := binary.Read(d.r, d.order, &n); err != nil {
+			return 0, errors.New("Reading vector length failed -> " + err.Error())
+		}
+		if n < 0 {
+			return 0, ErrBadMsg
+		}
+	} else {
+		var n32 uint32
+		if err := binary.Read(d.r, d.order, &n32); err != nil {
+			return 0, errors.New("Reading vector length failed -> " + err.Error())
+		}
+		n = int64(n32)
+	}
+	if d.size > 0 && n > d.size/elem {
+		return 0, ErrBadMsg
+	}
+	if d.opts.MaxVectorLength > 0 && n > int64(d.opts.MaxVectorLength) {
+		return 0, ErrDecodeLimit
+	}
+	if err := d.reserve(n * elem); err != nil {
+		return 0, err
+	}
+	return int(n), nil
+}
+
+func (d *decoder) readData() (kobj *K, err error) {
+	d.depth++
+	defer func() { d.depth-- }()
+	if d.opts.MaxDepth > 0 && d.depth > d.opts.MaxDepth {
+		return nil, ErrDecodeLimit
+	}
+	if err = d.reserve(kSize); err != nil {
+		return nil, err
+	}
+	r, order := d.r, d.order
 	var msgtype int8
 	err = binary.Read(r, order, &msgtype)
 	if err != nil {
@@ -119,39 +258,67 @@ func readData(r *bufio.Reader, order binary.ByteOrder) (kobj *K, err error) {
 	switch msgtype {
 	case -KB:
 		var b byte
-		binary.Read(r, order, &b)
+		if err = binary.Read(r, order, &b); err != nil {
+			return nil, err
+		}
 		return &K{msgtype, NONE, b != 0x0}, nil
 
 	case -UU:
 		var u uuid.UUID
-		binary.Read(r, order, &u)
+		if err = binary.Read(r, order, &u); err != nil {
+			return nil, err
+		}
 		return &K{msgtype, NONE, u}, nil
 
 	case -KG, -KC:
 		var b byte
-		binary.Read(r, order, &b)
+		if err = binary.Read(r, order, &b); err != nil {
+			return nil, err
+		}
 		return &K{msgtype, NONE, b}, nil
 	case -KH:
 		var sh int16
-		binary.Read(r, order, &sh)
+		if err = binary.Read(r, order, &sh); err != nil {
+			return nil, err
+		}
 		return &K{msgtype, NONE, sh}, nil
 
-	case -KI, -KD, -KU, -KV:
+	case -KI:
 		var i int32
-		binary.Read(r, order, &i)
+		if err = binary.Read(r, order, &i); err != nil {
+			return nil, err
+		}
 		return &K{msgtype, NONE, i}, nil
+	case -KD, -KU, -KV, -KT:
+		var i int32
+		if err = binary.Read(r, order, &i); err != nil {
+			return nil, err
+		}
+		return &K{msgtype, NONE, temporalValue(msgtype, i)}, nil
 	case -KJ:
 		var j int64
-		binary.Read(r, order, &j)
+		if err = binary.Read(r, order, &j); err != nil {
+			return nil, err
+		}
 		return &K{msgtype, NONE, j}, nil
 	case -KE:
 		var e float32
-		binary.Read(r, order, &e)
+		if err = binary.Read(r, order, &e); err != nil {
+			return nil, err
+		}
 		return &K{msgtype, NONE, e}, nil
-	case -KF, -KZ:
+	case -KF:
 		var f float64
-		binary.Read(r, order, &f)
+		if err = binary.Read(r, order, &f); err != nil {
+			return nil, err
+		}
 		return &K{msgtype, NONE, f}, nil
+	case -KZ:
+		var f float64
+		if err = binary.Read(r, order, &f); err != nil {
+			return nil, err
+		}
+		return &K{msgtype, NONE, datetimeTime(f)}, nil
 	case -KS:
 		line, err := r.ReadBytes(0)
 		if err != nil {
@@ -162,15 +329,21 @@ func readData(r *bufio.Reader, order binary.ByteOrder) (kobj *K, err error) {
 		return &K{msgtype, NONE, str}, nil
 	case -KP:
 		var ts time.Duration
-		binary.Read(r, order, &ts)
-		return &K{msgtype, NONE, qEpoch.Add(ts)}, nil
+		if err = binary.Read(r, order, &ts); err != nil {
+			return nil, err
+		}
+		return &K{msgtype, NONE, timestampTime(ts)}, nil
 	case -KM:
 		var m Month
-		binary.Read(r, order, &m)
+		if err = binary.Read(r, order, &m); err != nil {
+			return nil, err
+		}
 		return &K{msgtype, NONE, m}, nil
 	case -KN:
-		var span time.Duration
-		binary.Read(r, order, &span)
+		var span Timespan
+		if err = binary.Read(r, order, &span); err != nil {
+			return nil, err
+		}
 		return &K{msgtype, NONE, span}, nil
 	case KB, UU, KG, KH, KI, KJ, KE, KF, KC, KP, KM, KD, KN, KU, KV, KT, KZ:
 		var vecattr Attr
@@ -178,24 +351,24 @@ func readData(r *bufio.Reader, order binary.ByteOrder) (kobj *K, err error) {
 		if err != nil {
 			return nil, errors.New("readData: Failed to read vecattr:" + err.Error())
 		}
-		var veclen uint32
-		err = binary.Read(r, order, &veclen)
+		veclen, err := d.readLen(int64(typeSize[msgtype]))
 		if err != nil {
-			return nil, errors.New("Reading vector length failed -> " + err.Error())
+			return nil, err
 		}
 		var arr interface{}
-		if msgtype >= KB && msgtype <= KT {
-			bytedata := make([]byte, int(veclen)*typeSize[msgtype])
+		// raw bytes can be reinterpreted only if they are in host byte order
+		if msgtype >= KB && msgtype <= KT && (order == nativeOrder || typeSize[msgtype] == 1 || msgtype == UU) {
+			bytedata := make([]byte, veclen*typeSize[msgtype])
 			_, err = io.ReadFull(r, bytedata)
 			if err != nil {
 				return nil, errors.New("Not enough data - " + err.Error())
 			}
 			head := (*reflect.SliceHeader)(unsafe.Pointer(&bytedata))
-			head.Len = int(veclen)
-			head.Cap = int(veclen)
+			head.Len = veclen
+			head.Cap = veclen
 			arr = reflect.Indirect(reflect.NewAt(typeReflect[msgtype], unsafe.Pointer(&bytedata))).Interface()
 		} else {
-			arr = makeArray(msgtype, int(veclen))
+			arr = makeArray(msgtype, veclen)
 			err = binary.Read(r, order, arr)
 		}
 		if err != nil {
@@ -207,52 +380,48 @@ func readData(r *bufio.Reader, order binary.ByteOrder) (kobj *K, err error) {
 		if msgtype == KP {
 			arr := arr.([]time.Duration)
 			var timearr = make([]time.Time, veclen)
-			for i := 0; i < int(veclen); i++ {
-				timearr[i] = qEpoch.Add(arr[i])
+			for i := 0; i < veclen; i++ {
+				timearr[i] = timestampTime(arr[i])
 			}
 			return &K{msgtype, vecattr, timearr}, nil
 		}
 		if msgtype == KD {
 			arr := arr.([]int32)
-			var timearr = make([]time.Time, veclen)
-			for i := 0; i < int(veclen); i++ {
-				d := time.Duration(arr[i]) * 24 * time.Hour
-				timearr[i] = qEpoch.Add(d)
+			var timearr = make([]Date, veclen)
+			for i := 0; i < veclen; i++ {
+				timearr[i] = Date(epochTime(arr[i], day))
 			}
 			return &K{msgtype, vecattr, timearr}, nil
 		}
 		if msgtype == KZ {
 			arr := arr.([]float64)
 			var timearr = make([]time.Time, veclen)
-			for i := 0; i < int(veclen); i++ {
-				d := time.Duration(86400000*arr[i]) * time.Millisecond
-				timearr[i] = qEpoch.Add(d)
+			for i := 0; i < veclen; i++ {
+				timearr[i] = datetimeTime(arr[i])
 			}
 			return &K{msgtype, vecattr, timearr}, nil
 		}
 		if msgtype == KU {
 			arr := arr.([]int32)
 			var timearr = make([]Minute, veclen)
-			for i := 0; i < int(veclen); i++ {
-				d := time.Duration(arr[i]) * time.Minute
-				timearr[i] = Minute(time.Time{}.Add(d))
+			for i := 0; i < veclen; i++ {
+				timearr[i] = Minute(epochTime(arr[i], time.Minute))
 			}
 			return &K{msgtype, vecattr, timearr}, nil
 		}
 		if msgtype == KV {
 			arr := arr.([]int32)
 			var timearr = make([]Second, veclen)
-			for i := 0; i < int(veclen); i++ {
-				d := time.Duration(arr[i]) * time.Second
-				timearr[i] = Second(time.Time{}.Add(d))
+			for i := 0; i < veclen; i++ {
+				timearr[i] = Second(epochTime(arr[i], time.Second))
 			}
 			return &K{msgtype, vecattr, timearr}, nil
 		}
 		if msgtype == KT {
 			arr := arr.([]int32)
 			var timearr = make([]Time, veclen)
-			for i := 0; i < int(veclen); i++ {
-				timearr[i] = Time(qEpoch.Add(time.Duration(arr[i]) * time.Millisecond))
+			for i := 0; i < veclen; i++ {
+				timearr[i] = Time(epochTime(arr[i], time.Millisecond))
 			}
 			return &K{msgtype, vecattr, timearr}, nil
 		}
@@ -263,14 +432,13 @@ func readData(r *bufio.Reader, order binary.ByteOrder) (kobj *K, err error) {
 		if err != nil {
 			return nil, errors.New("readData: Failed to read vecattr ->" + err.Error())
 		}
-		var veclen uint32
-		err = binary.Read(r, order, &veclen)
+		veclen, err := d.readLen(1)
 		if err != nil {
-			return nil, errors.New("Reading vector length failed -> " + err.Error())
+			return nil, err
 		}
 		var arr = make([]*K, veclen)
-		for i := 0; i < int(veclen); i++ {
-			v, err := readData(r, order)
+		for i := 0; i < veclen; i++ {
+			v, err := d.readData()
 			if err != nil {
 				return nil, err
 			}
@@ -283,13 +451,12 @@ func readData(r *bufio.Reader, order binary.ByteOrder) (kobj *K, err error) {
 		if err != nil {
 			return nil, errors.New("readData: Failed to read vecattr ->" + err.Error())
 		}
-		var veclen uint32
-		err = binary.Read(r, order, &veclen)
+		veclen, err := d.readLen(1)
 		if err != nil {
-			return nil, errors.New("Reading vector length failed -> " + err.Error())
+			return nil, err
 		}
-		var arr = makeArray(msgtype, int(veclen)).([]string)
-		for i := 0; i < int(veclen); i++ {
+		var arr = makeArray(msgtype, veclen).([]string)
+		for i := 0; i < veclen; i++ {
 			line, err := r.ReadSlice(0)
 			if err != nil {
 				return nil, err
@@ -298,11 +465,11 @@ func readData(r *bufio.Reader, order binary.ByteOrder) (kobj *K, err error) {
 		}
 		return &K{msgtype, vecattr, arr}, nil
 	case XD, SD:
-		dk, err := readData(r, order)
+		dk, err := d.readData()
 		if err != nil {
 			return nil, err
 		}
-		dv, err := readData(r, order)
+		dv, err := d.readData()
 		if err != nil {
 			return nil, err
 		}
@@ -317,16 +484,22 @@ func readData(r *bufio.Reader, order binary.ByteOrder) (kobj *K, err error) {
 		if err != nil {
 			return nil, errors.New("readData: Failed to read vecattr" + err.Error())
 		}
-		d, err := readData(r, order)
+		v, err := d.readData()
 		if err != nil {
 			return nil, err
 		}
-		if d.Type != XD {
+		if v.Type != XD {
 			return nil, errors.New("expected dict")
 		}
-		dict := d.Data.(Dict)
-		colNames := dict.Key.Data.([]string)
-		colValues := dict.Value.Data.([]*K)
+		dict := v.Data.(Dict)
+		colNames, ok := dict.Key.Data.([]string)
+		if !ok || dict.Key.Type != KS {
+			return nil, ErrBadMsg
+		}
+		colValues, ok := dict.Value.Data.([]*K)
+		if !ok || dict.Value.Type != K0 || len(colNames) != len(colValues) {
+			return nil, ErrBadMsg
+		}
 		return &K{msgtype, vecattr, Table{colNames, colValues}}, nil
 
 	case KFUNC:
@@ -336,7 +509,7 @@ func readData(r *bufio.Reader, order binary.ByteOrder) (kobj *K, err error) {
 			return nil, err
 		}
 		f.Namespace = string(line[:len(line)-1])
-		b, err := readData(r, order)
+		b, err := d.readData()
 		if err != nil {
 			return nil, err
 		}
@@ -353,21 +526,20 @@ func readData(r *bufio.Reader, order binary.ByteOrder) (kobj *K, err error) {
 		}
 		return &K{msgtype, NONE, primitiveidx}, nil
 	case KPROJ, KCOMP:
-		var n uint32
-		err = binary.Read(r, order, &n)
+		n, err := d.readLen(1)
 		if err != nil {
 			return nil, err
 		}
 		var res = make([]*K, n)
 		for i := 0; i < len(res); i++ {
-			res[i], err = readData(r, order)
+			res[i], err = d.readData()
 			if err != nil {
 				return nil, err
 			}
 		}
 		return &K{msgtype, NONE, res}, nil
 	case KEACH, KOVER, KSCAN, KPRIOR, KEACHRIGHT, KEACHLEFT:
-		res, err := readData(r, order)
+		res, err := d.readData()
 		if err != nil {
 			return nil, err
 		}
@@ -381,7 +553,72 @@ func readData(r *bufio.Reader, order binary.ByteOrder) (kobj *K, err error) {
 			return nil, err
 		}
 		errmsg := string(line[:len(line)-1])
-		return nil, errors.New(errmsg)
+		return nil, QError(errmsg)
 	}
 	return nil, ErrBadMsg
 }
+
+// day is the unit of q dates
+const day = 24 * time.Hour
+
+// sinceEpoch returns time n units after q epoch.
+// Whole days are added separately so that large values do not overflow time.Duration.
+func sinceEpoch(n int64, unit time.Duration) time.Time {
+	perDay := int64(day / unit)
+	return qEpoch.AddDate(0, 0, int(n/perDay)).Add(time.Duration(n%perDay) * unit)
+}
+
+// datetimeTime converts q datetime, fractional days since q epoch, rounded to milliseconds
+func datetimeTime(f float64) time.Time {
+	ms := math.Round(f * 86400000)
+	switch {
+	case math.IsNaN(ms):
+		return NullTime
+	case ms >= math.MaxInt64:
+		return InfTime
+	case ms <= -math.MaxInt64:
+		return NegInfTime
+	}
+	return sinceEpoch(int64(ms), time.Millisecond)
+}
+
+// timestampTime converts q timestamp, nulls and infinities become NullTime, InfTime and NegInfTime
+func timestampTime(d time.Duration) time.Time {
+	switch int64(d) {
+	case Nj:
+		return NullTime
+	case Wj:
+		return InfTime
+	case -Wj:
+		return NegInfTime
+	}
+	return qEpoch.Add(d)
+}
+
+// epochTime converts n units since q epoch, nulls and infinities become NullTime, InfTime and NegInfTime
+func epochTime(n int32, unit time.Duration) time.Time {
+	switch n {
+	case Ni:
+		return NullTime
+	case Wi:
+		return InfTime
+	case -Wi:
+		return NegInfTime
+	}
+	return sinceEpoch(int64(n), unit)
+}
+
+// temporalValue converts atom i of type date, minute, second or time to its Go type
+func temporalValue(t int8, i int32) interface{} {
+	switch t {
+	case -KD:
+		return Date(epochTime(i, day))
+	case -KU:
+		return Minute(epochTime(i, time.Minute))
+	case -KV:
+		return Second(epochTime(i, time.Second))
+	case -KT:
+		return Time(epochTime(i, time.Millisecond))
+	}
+	return i
+}
@@ -3,9 +3,13 @@ package kdb
 import (
 	"bufio"
 	"bytes"
+	"encoding/binary"
+	"math"
 	"reflect"
 	"testing"
 	"time"
+
+	"github.com/nu7hatch/gouuid"
 )
 
 // 0b
@@ -43,6 +47,56 @@ func TestTimestampEpoch(t *testing.T) {
 	}
 }
 
+func TestTemporalTypes(t *testing.T) {
+	if m := NewMonth(DateAsTime); m != 161 || m.String() != "2013.06m" || !m.Time().Equal(time.Date(2013, 6, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Error("Wrong month", int32(m), m)
+	}
+	if m := Month(-1); m.String() != "1999.12m" {
+		t.Error("Wrong month before epoch", m)
+	}
+	d := 21*time.Hour + 53*time.Minute + 37963*time.Millisecond
+	if m := NewMinute(d); m.Duration() != 21*time.Hour+53*time.Minute || m.String() != "21:53" {
+		t.Error("Wrong minute", m)
+	}
+	if s := NewSecond(d); s.Duration() != 21*time.Hour+53*time.Minute+37*time.Second || s.String() != "21:53:37" {
+		t.Error("Wrong second", s)
+	}
+	if tm := NewTime(d); tm.Duration() != d || tm.String() != "21:53:37.963" {
+		t.Error("Wrong time", tm)
+	}
+	if dt := NewDate(time.Date(2013, 6, 10, 23, 0, 0, 0, time.FixedZone("", -3600))); dt.Time() != DateAsTime || dt.String() != "2013.06.10" {
+		t.Error("Wrong date", dt)
+	}
+	if n := Timespan(-(26*time.Hour + 1)); n.Duration() != -(26*time.Hour+1) || n.String() != "-1D02:00:00.000000001" {
+		t.Error("Wrong timespan", n)
+	}
+	// atoms and vectors of the same temporal type decode to the same Go type
+	m, sec := NewMinute(21*time.Hour+22*time.Minute), NewSecond(21*time.Hour+22*time.Minute+time.Second)
+	pairs := [][2]*K{
+		{{-KD, NONE, NewDate(DateAsTime)}, DateV([]Date{NewDate(DateAsTime)})},
+		{{-KN, NONE, Timespan(d)}, {KN, NONE, []Timespan{Timespan(d)}}},
+		{{-KZ, NONE, DatetimeAsTime}, {KZ, NONE, []time.Time{DatetimeAsTime}}},
+		{{-KU, NONE, m}, {KU, NONE, []Minute{m}}},
+		{{-KV, NONE, sec}, {KV, NONE, []Second{sec}}},
+		{{-KT, NONE, NewTime(d)}, {KT, NONE, []Time{NewTime(d)}}},
+	}
+	for _, p := range pairs {
+		var res [2]*K
+		for i, k := range p {
+			b, err := Encoder{Capability: DefaultCapability}.Marshal(SYNC, k)
+			if err != nil {
+				t.Fatal("Encoding failed:", err)
+			}
+			if res[i], _, err = Decode(bufio.NewReader(bytes.NewReader(b))); err != nil {
+				t.Fatal("Decoding failed:", err)
+			}
+		}
+		if x := res[1].Index(0); !reflect.DeepEqual(res[0].Data, p[0].Data) || !reflect.DeepEqual(x, p[0].Data) {
+			t.Errorf("Type %d decoded as %#v and %#v in vector, expected %#v", p[0].Type, res[0].Data, x, p[0].Data)
+		}
+	}
+}
+
 // -8!(2018.01.26D01:49:00.884361000 2018.01.26D01:49:00.884361000)
 var TimestampVectorAsBytes = []byte{0x01, 0x00, 0x00, 0x00, 0x1e, 0x00, 0x00, 0x00, 0x0c, 0x00, 0x02, 0x00, 0x00, 0x00, 0x28, 0xbf, 0xce, 0x27, 0x35, 0xec, 0xe9, 0x07, 0x28, 0xbf, 0xce, 0x27, 0x35, 0xec, 0xe9, 0x07}
 
@@ -158,12 +212,135 @@ func TestDecoding(t *testing.T) {
 		if tt.input.Type == KERR {
 			d = Error(err)
 		}
-		if !reflect.DeepEqual(d, tt.input) {
+		if !decodedAs(d, tt.input) {
 			t.Errorf("Decoded '%s' incorrectly. Expected '%#v', got '%#v'\n", tt.desc, tt.input, d)
 		}
 	}
 }
 
+// decodedAs reports whether d is decoded input, which may hold raw values of temporal types, e.g. int32 for minutes
+func decodedAs(d, input *K) bool {
+	if reflect.DeepEqual(d, input) {
+		return true
+	}
+	if d == nil || d.Type != input.Type || d.Attr != input.Attr {
+		return false
+	}
+	if d.Type < 0 {
+		return reflect.DeepEqual(atomValue(d.Type, d.Data), atomValue(input.Type, input.Data))
+	}
+	return reflect.DeepEqual(vectorValue(d.Type, d.Data), vectorValue(input.Type, input.Data))
+}
+
+// nested returns list nested depth times
+func nested(depth int) *K {
+	k := Long(1)
+	for i := 1; i < depth; i++ {
+		k = NewList(k)
+	}
+	return k
+}
+
+func TestDecodeLimits(t *testing.T) {
+	tests := []struct {
+		desc  string
+		input *K
+		opts  DecodeOptions
+		err   error
+	}{
+		{"no limits", LongV(make([]int64, 1000)), DecodeOptions{}, nil},
+		{"message size", LongV(make([]int64, 1000)), DecodeOptions{MaxMessageSize: 1000}, ErrDecodeLimit},
+		{"uncompressed size", &K{KB, NONE, make([]bool, 2000)}, DecodeOptions{MaxMessageSize: 1000}, ErrDecodeLimit},
+		{"vector length", NewList(LongV(make([]int64, 10)), SymbolV(make([]string, 11))), DecodeOptions{MaxVectorLength: 10}, ErrDecodeLimit},
+		{"vector length within limit", NewList(LongV(make([]int64, 10))), DecodeOptions{MaxVectorLength: 10}, nil},
+		{"allocation", LongV(make([]int64, 1000)), DecodeOptions{MaxAlloc: 4000}, ErrDecodeLimit},
+		{"depth", nested(6), DecodeOptions{MaxDepth: 5}, ErrDecodeLimit},
+		{"depth within limit", nested(5), DecodeOptions{MaxDepth: 5}, nil},
+	}
+	for _, tt := range tests {
+		buf := new(bytes.Buffer)
+		if err := Encode(buf, ASYNC, tt.input); err != nil {
+			t.Fatal("Encoding failed", err)
+		}
+		_, _, err := tt.opts.Decode(bufio.NewReader(buf))
+		if err != tt.err {
+			t.Errorf("%s: expected %v, got %v", tt.desc, tt.err, err)
+		}
+	}
+}
+
+func TestDecodeBadLength(t *testing.T) {
+	// long vector claiming 2^31 elements in 30 byte message
+	msg := []byte{0x01, 0x00, 0x00, 0x00, 0x1e, 0x00, 0x00, 0x00, 0x07, 0x00, 0x00, 0x00, 0x00, 0x80, 0x01, 0, 0, 0, 0, 0, 0, 0, 0x02, 0, 0, 0, 0, 0, 0, 0}
+	if _, _, err := Decode(bufio.NewReader(bytes.NewReader(msg))); err != ErrBadMsg {
+		t.Error("Expected bad message, got", err)
+	}
+	// truncated compressed message
+	msg = append([]byte{0x01, 0x00, 0x01, 0x00, 0x1e, 0x00, 0x00, 0x00}, bytes2KTrue[8:30]...)
+	if _, _, err := Decode(bufio.NewReader(bytes.NewReader(msg))); err != ErrBadCompression {
+		t.Error("Expected bad compression, got", err)
+	}
+}
+
+func TestDecodeBadTable(t *testing.T) {
+	dicts := []*K{
+		NewDict(LongV([]int64{1}), NewList(LongV([]int64{1}))),
+		NewDict(SymbolV([]string{"a"}), LongV([]int64{1})),
+		NewDict(SymbolV([]string{"a", "b"}), NewList(LongV([]int64{1}))),
+	}
+	for _, dict := range dicts {
+		buf := bytes.NewBuffer([]byte{byte(XT), byte(NONE)})
+		if err := EncodeData(buf, dict); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := DecodeData(bufio.NewReader(buf)); err != ErrBadMsg {
+			t.Errorf("Expected bad message for table of %v, got %v", dict, err)
+		}
+	}
+}
+
+// -8!1 2i on big-endian host
+var bigEndianIntVecBytes = []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x16, 0x06, 0x00, 0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x02}
+
+func TestBigEndian(t *testing.T) {
+	d, _, err := Decode(bufio.NewReader(bytes.NewReader(bigEndianIntVecBytes)))
+	if err != nil || !reflect.DeepEqual(d, IntV([]int32{1, 2})) {
+		t.Errorf("Decoding big-endian message failed: %v %v", d, err)
+	}
+	b, err := Encoder{Capability: DefaultCapability, Order: binary.BigEndian}.Marshal(ASYNC, IntV([]int32{1, 2}))
+	if err != nil || !bytes.Equal(b, bigEndianIntVecBytes) {
+		t.Errorf("Encoding big-endian message failed: %v %v", b, err)
+	}
+	inputs := []*K{
+		Long(-2),
+		&K{-KP, NONE, time.Date(2024, 1, 2, 3, 4, 5, 6, time.UTC)},
+		&K{KP, NONE, []time.Time{time.Date(2024, 1, 2, 3, 4, 5, 6, time.UTC)}},
+		IntV([]int32{1, -1}),
+		&K{KM, NONE, []Month{1, 2}},
+		&K{KN, NONE, []Timespan{Timespan(time.Second)}},
+		RealV([]float32{1.5}),
+		FloatV([]float64{2.5, math.Inf(1)}),
+		&K{UU, NONE, []uuid.UUID{{1, 2, 3}}},
+		NewTable([]string{"sym", "size"}, []*K{SymbolV([]string{"a", "b"}), LongV([]int64{1, 2})}),
+		NewDict(SymbolV([]string{"a"}), NewList(&K{KC, NONE, "str"})),
+		// compressed
+		LongV(make([]int64, 1000)),
+	}
+	for _, input := range inputs {
+		b, err := Encoder{Capability: DefaultCapability, Order: binary.BigEndian}.Marshal(SYNC, input)
+		if err != nil {
+			t.Fatal("Encoding failed", err)
+		}
+		if b[0] != 0 {
+			t.Error("Message is not big-endian", b[:8])
+		}
+		d, msgtype, err := Decode(bufio.NewReader(bytes.NewReader(b)))
+		if err != nil || msgtype != SYNC || !reflect.DeepEqual(d, input) {
+			t.Errorf("Big-endian roundtrip failed expected/got: \n%v\n%v %v\n", input, d, err)
+		}
+	}
+}
+
 func BenchmarkDecodeAll(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		for _, tt := range encodingTests {
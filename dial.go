@@ -0,0 +1,267 @@
+package kdb
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"net"
+	"runtime"
+	"time"
+)
+
+// CompressionPolicy decides whether outgoing message of size bytes should be compressed.
+// local reports whether the peer runs on the same host.
+// Message is sent uncompressed anyway if compression does not reduce its size.
+type CompressionPolicy func(size int, local bool) bool
+
+// CompressAlways compresses every message
+func CompressAlways(size int, local bool) bool {
+	return true
+}
+
+// CompressDefault compresses messages larger than 2000 bytes unless the peer is local, same as q does.
+// This is the default.
+func CompressDefault(size int, local bool) bool {
+	return size > 2000 && !local
+}
+
+// CompressNever disables compression
+func CompressNever(size int, local bool) bool {
+	return false
+}
+
+// DialOption configures connection established by Dial
+type DialOption func(*dialConfig)
+
+// defaultHandshakeTimeout bounds handshakes unless configured otherwise,
+// so that dialling a listener which is not q does not hang
+const defaultHandshakeTimeout = 30 * time.Second
+
+type dialConfig struct {
+	auth             string
+	capability       byte
+	creds            CredentialSource
+	tls              *tls.Config
+	unix             bool
+	connectTimeout   time.Duration
+	handshakeTimeout time.Duration
+	keepAlive        time.Duration
+	readBufferSize   int
+	writeBufferSize  int
+	compress         CompressionPolicy
+	stats            *CompressionStats
+}
+
+// WithAuth sets credentials as user:password string
+func WithAuth(auth string) DialOption {
+	return func(c *dialConfig) {
+		c.auth = auth
+	}
+}
+
+// WithCapability sets IPC capability requested during handshake. Defaults to DefaultCapability.
+func WithCapability(capability byte) DialOption {
+	return func(c *dialConfig) {
+		c.capability = capability
+	}
+}
+
+// WithCredentials sets user and password
+func WithCredentials(user, password string) DialOption {
+	return WithAuth(user + ":" + password)
+}
+
+// WithTLS enables TLS using cfg. If cfg.ServerName is empty it is set to the host being dialled.
+func WithTLS(cfg *tls.Config) DialOption {
+	return func(c *dialConfig) {
+		c.tls = cfg
+	}
+}
+
+// WithUnix connects using unix domain socket of q process listening on the port. Host is ignored.
+func WithUnix() DialOption {
+	return func(c *dialConfig) {
+		c.unix = true
+	}
+}
+
+// WithConnectTimeout limits time to establish connection
+func WithConnectTimeout(d time.Duration) DialOption {
+	return func(c *dialConfig) {
+		c.connectTimeout = d
+	}
+}
+
+// WithHandshakeTimeout limits time for TLS and q handshakes. Defaults to 30 seconds.
+func WithHandshakeTimeout(d time.Duration) DialOption {
+	return func(c *dialConfig) {
+		c.handshakeTimeout = d
+	}
+}
+
+// WithKeepAlive sets TCP keep-alive period. Negative value disables keep-alives.
+func WithKeepAlive(d time.Duration) DialOption {
+	return func(c *dialConfig) {
+		c.keepAlive = d
+	}
+}
+
+// WithReadBufferSize sets size of buffer used to read messages
+func WithReadBufferSize(n int) DialOption {
+	return func(c *dialConfig) {
+		c.readBufferSize = n
+	}
+}
+
+// WithWriteBufferSize sets size of operating system send buffer of the socket
+func WithWriteBufferSize(n int) DialOption {
+	return func(c *dialConfig) {
+		c.writeBufferSize = n
+	}
+}
+
+// WithCompression sets policy for compressing outgoing messages
+func WithCompression(p CompressionPolicy) DialOption {
+	return func(c *dialConfig) {
+		c.compress = p
+	}
+}
+
+// WithCompressionStats accumulates compression metrics of outgoing messages in s
+func WithCompressionStats(s *CompressionStats) DialOption {
+	return func(c *dialConfig) {
+		c.stats = s
+	}
+}
+
+// newDialConfig applies opts to defaults and resolves credentials from credential source
+func newDialConfig(ctx context.Context, opts []DialOption) (*dialConfig, error) {
+	var cfg = dialConfig{capability: DefaultCapability, handshakeTimeout: defaultHandshakeTimeout}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if cfg.creds != nil {
+		user, password, err := cfg.creds.Credentials(ctx)
+		if err != nil {
+			return nil, err
+		}
+		cfg.auth = user + ":" + password
+	}
+	return &cfg, nil
+}
+
+// handshakeContext bounds ctx by handshake timeout
+func (cfg *dialConfig) handshakeContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if cfg.handshakeTimeout > 0 {
+		return context.WithTimeout(ctx, cfg.handshakeTimeout)
+	}
+	return ctx, func() {}
+}
+
+// Dial connects to kdb+ process listening on addr in host:port form and performs q handshake.
+// Connection and handshakes are bounded by ctx.
+func Dial(ctx context.Context, addr string, opts ...DialOption) (*KDBConn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := newDialConfig(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	dctx := ctx
+	if cfg.connectTimeout > 0 {
+		var cancel context.CancelFunc
+		dctx, cancel = context.WithTimeout(ctx, cfg.connectTimeout)
+		defer cancel()
+	}
+	d := net.Dialer{KeepAlive: cfg.keepAlive}
+	var conn net.Conn
+	var local bool
+	if cfg.unix {
+		path, err := unixSocketPath(port)
+		if err != nil {
+			return nil, err
+		}
+		conn, err = d.DialContext(dctx, "unix", path)
+		if err != nil {
+			return nil, err
+		}
+		local = true
+	} else {
+		conn, err = d.DialContext(dctx, "tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		local = isLocal(conn.RemoteAddr())
+	}
+	if cfg.writeBufferSize > 0 {
+		if wb, ok := conn.(interface{ SetWriteBuffer(int) error }); ok {
+			wb.SetWriteBuffer(cfg.writeBufferSize)
+		}
+	}
+
+	hctx, cancel := cfg.handshakeContext(ctx)
+	defer cancel()
+	if cfg.tls != nil {
+		tcfg := cfg.tls
+		if tcfg.ServerName == "" {
+			tcfg = tcfg.Clone()
+			tcfg.ServerName = host
+		}
+		tc := tls.Client(conn, tcfg)
+		if err = tc.HandshakeContext(hctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tc
+	}
+	c, err := handshake(hctx, conn, cfg)
+	if err != nil {
+		return nil, err
+	}
+	c.Host, c.Port, c.local = host, port, local
+	if cfg.unix {
+		c.Host = ""
+	}
+	c.redial = func(ctx context.Context) (*KDBConn, error) {
+		return Dial(ctx, addr, opts...)
+	}
+	return c, nil
+}
+
+// handshake performs q handshake on conn bounded by ctx and returns connection ready for use
+func handshake(ctx context.Context, conn net.Conn, cfg *dialConfig) (*KDBConn, error) {
+	c := &KDBConn{
+		con:      conn,
+		userpwd:  cfg.auth,
+		compress: cfg.compress,
+		stats:    cfg.stats,
+		rsem:     make(chan struct{}, 1),
+	}
+	var err error
+	stop := c.watch(ctx, conn.SetDeadline)
+	c.capability, err = kdbHandshake(conn, cfg.auth, cfg.capability)
+	if err = stop(err); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if cfg.readBufferSize > 0 {
+		c.rbuf = bufio.NewReaderSize(conn, cfg.readBufferSize)
+	} else {
+		c.rbuf = bufio.NewReader(conn)
+	}
+	return c, nil
+}
+
+// unixSocketPath returns path of unix domain socket q listens on for port
+func unixSocketPath(port string) (string, error) {
+	switch runtime.GOOS {
+	case "linux":
+		return "@/tmp/kx." + port, nil
+	case "darwin":
+		return "/tmp/kx." + port, nil
+	}
+	return "", net.UnknownNetworkError("unix")
+}
@@ -0,0 +1,115 @@
+package kdb
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// testTLSConfig returns server config with self-signed certificate
+func testTLSConfig() *tls.Config {
+	s := httptest.NewUnstartedServer(nil)
+	s.StartTLS()
+	s.Close()
+	return &tls.Config{Certificates: s.TLS.Certificates}
+}
+
+func TestDial(t *testing.T) {
+	port := mockServer(t, echoServer)
+	addr := net.JoinHostPort("localhost", strconv.Itoa(port))
+	con, err := Dial(context.Background(), addr, WithCredentials("user", "pwd"),
+		WithConnectTimeout(time.Second), WithHandshakeTimeout(time.Second),
+		WithKeepAlive(time.Minute), WithReadBufferSize(1<<20), WithWriteBufferSize(1<<20))
+	if err != nil {
+		t.Fatalf("Failed to connect to mock server: %s", err)
+	}
+	defer con.Close()
+	if con.Host != "localhost" || con.Port != strconv.Itoa(port) {
+		t.Errorf("Unexpected host/port: %s/%s", con.Host, con.Port)
+	}
+	if con.userpwd != "user:pwd" || !con.local {
+		t.Error("Connection was not configured from options")
+	}
+	if _, err = con.Call("echo", Long(1)); err != nil {
+		t.Error("Call failed", err)
+	}
+}
+
+func TestDialTLSTimeout(t *testing.T) {
+	ln, err := tls.Listen("tcp", "localhost:0", testTLSConfig())
+	if err != nil {
+		t.Fatal("Failed to listen:", err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		rbuf := bufio.NewReader(conn)
+		rbuf.ReadBytes(0)
+		conn.Write([]byte{3})
+		echoServer(&bufferedConn{conn, rbuf})
+	}()
+	con, err := Dial(context.Background(), ln.Addr().String(),
+		WithTLS(&tls.Config{InsecureSkipVerify: true}), WithConnectTimeout(time.Second), WithHandshakeTimeout(time.Second))
+	if err != nil {
+		t.Fatalf("Failed to connect via TLS: %s", err)
+	}
+	defer con.Close()
+	if _, err = con.Call("echo", Long(1)); err != nil {
+		t.Error("Call via TLS failed", err)
+	}
+}
+
+func TestDialHandshakeTimeout(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal("Failed to listen:", err)
+	}
+	defer ln.Close()
+	go func() {
+		// accept and never reply to handshake
+		conn, err := ln.Accept()
+		if err == nil {
+			defer conn.Close()
+			time.Sleep(time.Second)
+		}
+	}()
+	start := time.Now()
+	_, err = Dial(context.Background(), ln.Addr().String(), WithHandshakeTimeout(50*time.Millisecond))
+	if err != context.DeadlineExceeded {
+		t.Error("Expected deadline error, got", err)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Error("Handshake timeout was not applied, dial took", d)
+	}
+}
+
+func TestDialCompression(t *testing.T) {
+	compressed := make(chan byte, 1)
+	port := mockServer(t, func(conn net.Conn) {
+		defer conn.Close()
+		var header [8]byte
+		if _, err := conn.Read(header[:]); err == nil {
+			compressed <- header[2]
+		}
+	})
+	addr := net.JoinHostPort("localhost", strconv.Itoa(port))
+	con, err := Dial(context.Background(), addr, WithCompression(CompressNever))
+	if err != nil {
+		t.Fatalf("Failed to connect to mock server: %s", err)
+	}
+	defer con.Close()
+	if err = con.AsyncCall("set", Symbol("x"), &K{KJ, NONE, make([]int64, 10000)}); err != nil {
+		t.Fatal("Async call failed", err)
+	}
+	if c := <-compressed; c != 0 {
+		t.Error("Message was compressed")
+	}
+}
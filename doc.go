@@ -1,4 +1,25 @@
 // Package kdb implements encoding and decoding of q ipc message format
+//
+// Temporal types are decoded to the same Go types for atoms and vectors, and encoded back from them:
+//
+//	timestamp	time.Time
+//	month		Month
+//	date		Date, midnight UTC
+//	datetime	time.Time with millisecond precision
+//	timespan	Timespan
+//	minute		Minute
+//	second		Second
+//	time		Time
+//
+// Minute, Second and Time hold time of day on 2000.01.01, values outside a day keep their offset from that date.
+// Encoding also accepts time.Time for date, time.Duration for timespan and raw wire values, e.g. int32 days for date.
+//
+// Date used to be a constructor of date atoms and DateV took []time.Time. Use DateAtom(t) for atoms
+// and DateV(NewDates(ts)) for time.Time slices instead.
+//
+// Nulls and infinities of types mapped to time.Time, Date, Minute, Second and Time are NullTime, InfTime and NegInfTime,
+// other types keep q values such as Ni, Wj or Nf. K.IsNull and K.IsInf report them for any type.
+// UnmarshalDict and Registry set pointers to nil for nulls and pass nil to sql.Scanner, e.g. sql.NullString or Nullable.
 package kdb
 
 /*
@@ -4,14 +4,21 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
+	"math"
 	"reflect"
 	"strconv"
+	"sync/atomic"
 	"time"
 )
 
-func writeData(dbuf io.Writer, order binary.ByteOrder, data *K) (err error) {
-	binary.Write(dbuf, order, data.Type)
+func (e Encoder) writeData(dbuf io.Writer, order binary.ByteOrder, data *K) (err error) {
+	t := data.Type
+	if t == XD && data.Attr == SORTED {
+		t = SD
+	}
+	binary.Write(dbuf, order, t)
 	if data.Type >= K0 && data.Type < XD {
 		binary.Write(dbuf, order, data.Attr) // attributes
 
@@ -19,9 +26,9 @@ func writeData(dbuf io.Writer, order binary.ByteOrder, data *K) (err error) {
 	switch data.Type {
 	case K0:
 		tosend := data.Data.([]*K)
-		binary.Write(dbuf, order, int32(len(tosend)))
+		e.writeLen(dbuf, order, len(tosend))
 		for i := 0; i < len(tosend); i++ {
-			err = writeData(dbuf, order, tosend[i])
+			err = e.writeData(dbuf, order, tosend[i])
 			if err != nil {
 				return err
 			}
@@ -31,59 +38,54 @@ func writeData(dbuf io.Writer, order binary.ByteOrder, data *K) (err error) {
 		binary.Write(dbuf, order, []byte(tosend))
 		binary.Write(dbuf, order, byte(0))
 	case KC:
-		tosend := data.Data.(string)
-		binary.Write(dbuf, order, int32(len(tosend)))
-		binary.Write(dbuf, order, []byte(tosend))
+		var tosend []byte
+		switch x := data.Data.(type) {
+		case string:
+			tosend = []byte(x)
+		case []byte:
+			tosend = x
+		default:
+			return invalidData(data)
+		}
+		e.writeLen(dbuf, order, len(tosend))
+		binary.Write(dbuf, order, tosend)
 	case KS:
 		tosend := data.Data.([]string)
-		binary.Write(dbuf, order, int32(len(tosend)))
+		e.writeLen(dbuf, order, len(tosend))
 		for i := 0; i < len(tosend); i++ {
 			binary.Write(dbuf, order, []byte(tosend[i]))
 			binary.Write(dbuf, order, byte(0))
 		}
-	case -KB:
-		tosend := data.Data.(bool)
-		var val byte
-		if tosend {
-			val = 0x01
-		} else {
-			val = 0x00
-		}
-		binary.Write(dbuf, order, val)
-	case -KG, -KH, -KI, -KJ, -KE, -KF, -UU:
-		binary.Write(dbuf, order, data.Data)
-	case -KP:
-		tosend := data.Data.(time.Time)
-		binary.Write(dbuf, order, tosend.Sub(qEpoch))
-	case KP:
-		binary.Write(dbuf, order, int32(reflect.ValueOf(data.Data).Len()))
-		tosend := data.Data.([]time.Time)
-		for _, ts := range tosend {
-			binary.Write(dbuf, order, ts.Sub(qEpoch))
-		}
-	case KB:
-		binary.Write(dbuf, order, int32(reflect.ValueOf(data.Data).Len()))
-		tosend := data.Data.([]bool)
-		boolmap := map[bool]byte{false: 0x00, true: 0x01}
-		for _, b := range tosend {
-			binary.Write(dbuf, order, boolmap[b])
-		}
-	case KG, KI, KJ, KE, KF, KZ, KT, KD, KV, KU, KM, KN, UU:
-		binary.Write(dbuf, order, int32(reflect.ValueOf(data.Data).Len()))
-		binary.Write(dbuf, order, data.Data)
-	case XD:
+	case -KB, -UU, -KG, -KH, -KI, -KJ, -KE, -KF, -KC, -KP, -KM, -KD, -KZ, -KN, -KU, -KV, -KT:
+		v := atomValue(data.Type, data.Data)
+		if binary.Size(v) != typeSize[-data.Type] {
+			return invalidData(data)
+		}
+		return binary.Write(dbuf, order, v)
+	case KB, UU, KG, KH, KI, KJ, KE, KF, KP, KM, KD, KZ, KN, KU, KV, KT:
+		rv := reflect.ValueOf(data.Data)
+		if rv.Kind() != reflect.Slice {
+			return invalidData(data)
+		}
+		v := vectorValue(data.Type, data.Data)
+		if binary.Size(v) != rv.Len()*typeSize[data.Type] {
+			return invalidData(data)
+		}
+		e.writeLen(dbuf, order, rv.Len())
+		return binary.Write(dbuf, order, v)
+	case XD, SD:
 		tosend := data.Data.(Dict)
-		err = writeData(dbuf, order, tosend.Key)
+		err = e.writeData(dbuf, order, tosend.Key)
 		if err != nil {
 			return err
 		}
-		err = writeData(dbuf, order, tosend.Value)
+		err = e.writeData(dbuf, order, tosend.Value)
 		if err != nil {
 			return err
 		}
 	case XT:
 		tosend := data.Data.(Table)
-		err = writeData(dbuf, order, NewDict(SymbolV(tosend.Columns), &K{K0, NONE, tosend.Data}))
+		err = e.writeData(dbuf, order, NewDict(SymbolV(tosend.Columns), &K{K0, NONE, tosend.Data}))
 		if err != nil {
 			return err
 		}
@@ -95,24 +97,24 @@ func writeData(dbuf io.Writer, order binary.ByteOrder, data *K) (err error) {
 		tosend := data.Data.(Function)
 		binary.Write(dbuf, order, []byte(tosend.Namespace))
 		binary.Write(dbuf, order, byte(0))
-		err = writeData(dbuf, order, &K{KC, NONE, tosend.Body})
+		err = e.writeData(dbuf, order, &K{KC, NONE, tosend.Body})
 		if err != nil {
 			return err
 		}
 	case KPROJ, KCOMP:
 		d := data.Data.([]*K)
-		err = binary.Write(dbuf, order, int32(len(d)))
+		err = e.writeLen(dbuf, order, len(d))
 		if err != nil {
 			return err
 		}
 		for i := 0; i < len(d); i++ {
-			err = writeData(dbuf, order, d[i])
+			err = e.writeData(dbuf, order, d[i])
 			if err != nil {
 				return err
 			}
 		}
 	case KEACH, KOVER, KSCAN, KPRIOR, KEACHRIGHT, KEACHLEFT:
-		return writeData(dbuf, order, data.Data.(*K))
+		return e.writeData(dbuf, order, data.Data.(*K))
 	case KFUNCUP, KFUNCBP, KFUNCTR:
 		b := data.Data.(byte)
 		err = binary.Write(dbuf, order, &b)
@@ -126,33 +128,341 @@ func writeData(dbuf io.Writer, order binary.ByteOrder, data *K) (err error) {
 
 }
 
-// Encode data to ipc format as msgtype(sync/async/response) to specified writer
+// invalidData is returned when Go type of data does not match its q type
+func invalidData(data *K) error {
+	return fmt.Errorf("invalid data %T for type %d", data.Data, data.Type)
+}
+
+// atomValue converts temporal atom x of type t to its wire representation, other atoms are returned as is
+func atomValue(t int8, x interface{}) interface{} {
+	switch v := x.(type) {
+	case time.Time:
+		switch t {
+		case -KP:
+			return qTimestamp(v)
+		case -KD:
+			return qInt(v, day)
+		case -KZ:
+			return qDatetime(v)
+		}
+	case Date:
+		return qInt(time.Time(v), day)
+	case Timespan:
+		return time.Duration(v)
+	case Minute:
+		return qInt(time.Time(v), time.Minute)
+	case Second:
+		return qInt(time.Time(v), time.Second)
+	case Time:
+		return qInt(time.Time(v), time.Millisecond)
+	}
+	return x
+}
+
+// vectorValue converts temporal vector x of type t to its wire representation, other vectors are returned as is
+func vectorValue(t int8, x interface{}) interface{} {
+	switch v := x.(type) {
+	case []time.Time:
+		switch t {
+		case KP:
+			res := make([]time.Duration, len(v))
+			for i, ts := range v {
+				res[i] = qTimestamp(ts)
+			}
+			return res
+		case KD:
+			res := make([]int32, len(v))
+			for i, ts := range v {
+				res[i] = qInt(ts, day)
+			}
+			return res
+		case KZ:
+			res := make([]float64, len(v))
+			for i, ts := range v {
+				res[i] = qDatetime(ts)
+			}
+			return res
+		}
+	case []Timespan:
+		res := make([]time.Duration, len(v))
+		for i, n := range v {
+			res[i] = time.Duration(n)
+		}
+		return res
+	case []Date, []Minute, []Second, []Time:
+		rv := reflect.ValueOf(v)
+		res := make([]int32, rv.Len())
+		for i := range res {
+			res[i] = atomValue(-t, rv.Index(i).Interface()).(int32)
+		}
+		return res
+	}
+	return x
+}
+
+// epochUnits returns whole units from q epoch to t rounded down, saturating instead of overflowing
+func epochUnits(t time.Time, unit time.Duration) int64 {
+	s := t.Unix() - qEpoch.Unix()
+	if unit < time.Second {
+		m := int64(time.Second / unit)
+		switch {
+		case s >= math.MaxInt64/m:
+			return math.MaxInt64
+		case s <= math.MinInt64/m:
+			return math.MinInt64
+		}
+		return s*m + int64(t.Nanosecond())/int64(unit)
+	}
+	n := int64(unit / time.Second)
+	d := s / n
+	if s%n < 0 {
+		d--
+	}
+	return d
+}
+
+// qTimestamp returns nanoseconds from q epoch to t, times out of range become infinities
+func qTimestamp(t time.Time) time.Duration {
+	switch {
+	case t.IsZero():
+		return time.Duration(Nj)
+	case !t.Before(InfTime):
+		return time.Duration(Wj)
+	case !t.After(NegInfTime):
+		return time.Duration(-Wj)
+	}
+	d := t.Sub(qEpoch)
+	if int64(d) == Nj {
+		return time.Duration(-Wj)
+	}
+	return d
+}
+
+// qInt returns whole units from q epoch to t as int, times out of range become infinities
+func qInt(t time.Time, unit time.Duration) int32 {
+	switch {
+	case t.IsZero():
+		return Ni
+	case !t.Before(InfTime):
+		return Wi
+	case !t.After(NegInfTime):
+		return -Wi
+	}
+	n := epochUnits(t, unit)
+	if n > int64(Wi) {
+		return Wi
+	}
+	if n < -int64(Wi) {
+		return -Wi
+	}
+	return int32(n)
+}
+
+// qDatetime returns fractional days from q epoch to t with millisecond precision
+func qDatetime(t time.Time) float64 {
+	switch {
+	case t.IsZero():
+		return math.NaN()
+	case !t.Before(InfTime):
+		return math.Inf(1)
+	case !t.After(NegInfTime):
+		return math.Inf(-1)
+	}
+	return float64(epochUnits(t, time.Millisecond)) / 86400000
+}
+
+// writeLen writes vector length
+func (e Encoder) writeLen(dbuf io.Writer, order binary.ByteOrder, n int) error {
+	if e.wide {
+		return binary.Write(dbuf, order, int64(n))
+	}
+	return binary.Write(dbuf, order, int32(n))
+}
+
+// Encode data to ipc format as msgtype(sync/async/response) to specified writer.
+// Message is always compressed, use Encoder to choose compression policy.
 func Encode(w io.Writer, msgtype ReqType, data *K) error {
-	var order = binary.LittleEndian
+	return Encoder{Capability: DefaultCapability}.Encode(w, msgtype, data)
+}
+
+// EncodeData writes data serialised without message header, the way q stores objects in files and journals
+func EncodeData(w io.Writer, data *K) error {
+	buf := new(bytes.Buffer)
+	if err := (Encoder{Capability: DefaultCapability}).writeData(buf, binary.LittleEndian, data); err != nil {
+		return err
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// Encoder serialises messages for peer with given IPC capability
+type Encoder struct {
+	// Capability of the peer, data containing types it does not support is rejected
+	Capability byte
+	// Compression decides whether message should be compressed, always if nil
+	Compression CompressionPolicy
+	// Local is passed to Compression, set if the peer runs on the same host
+	Local bool
+	// Order is byte order of the message, little endian if nil
+	Order binary.ByteOrder
+	// Stats accumulates compression metrics if not nil
+	Stats *CompressionStats
+	// wide is set for large messages where vector lengths take 8 bytes
+	wide bool
+}
+
+// CompressionStats counts encoded messages and bytes saved by compressing them.
+// It can be shared by many connections and is safe for concurrent use.
+type CompressionStats struct {
+	messages   int64
+	compressed int64
+	size       int64
+	sent       int64
+}
+
+// add records message of given size sent as n bytes
+func (s *CompressionStats) add(size, n int) {
+	atomic.AddInt64(&s.messages, 1)
+	if n < size {
+		atomic.AddInt64(&s.compressed, 1)
+	}
+	atomic.AddInt64(&s.size, int64(size))
+	atomic.AddInt64(&s.sent, int64(n))
+}
+
+// Messages returns number of messages encoded
+func (s *CompressionStats) Messages() int64 {
+	return atomic.LoadInt64(&s.messages)
+}
+
+// Compressed returns number of messages sent compressed
+func (s *CompressionStats) Compressed() int64 {
+	return atomic.LoadInt64(&s.compressed)
+}
+
+// Size returns total size of encoded messages before compression
+func (s *CompressionStats) Size() int64 {
+	return atomic.LoadInt64(&s.size)
+}
+
+// Sent returns total size of encoded messages after compression
+func (s *CompressionStats) Sent() int64 {
+	return atomic.LoadInt64(&s.sent)
+}
+
+// Saved returns number of bytes saved by compression
+func (s *CompressionStats) Saved() int64 {
+	return s.Size() - s.Sent()
+}
+
+// CapabilityError is returned when data contains type peer cannot understand
+type CapabilityError struct {
+	Type       int8
+	Capability byte
+}
+
+func (e *CapabilityError) Error() string {
+	return fmt.Sprintf("type %d is not supported by peer with IPC capability %d", e.Type, e.Capability)
+}
+
+// checkCapability verifies that all types within data are supported by peer with given capability
+func checkCapability(data *K, capability byte) error {
+	t := data.Type
+	if t < 0 {
+		t = -t
+	}
+	switch {
+	case t == UU && capability < CapabilityV30,
+		(t == KP || t == KN) && capability < CapabilityV26:
+		return &CapabilityError{data.Type, capability}
+	}
+	var children []*K
+	switch data.Type {
+	case K0, KPROJ, KCOMP:
+		children = data.Data.([]*K)
+	case XD, SD:
+		d := data.Data.(Dict)
+		children = []*K{d.Key, d.Value}
+	case XT:
+		children = data.Data.(Table).Data
+	case KEACH, KOVER, KSCAN, KPRIOR, KEACHRIGHT, KEACHLEFT:
+		children = []*K{data.Data.(*K)}
+	}
+	for _, child := range children {
+		if err := checkCapability(child, capability); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Encode writes data as ipc message of msgtype to w
+func (e Encoder) Encode(w io.Writer, msgtype ReqType, data *K) error {
+	b, err := e.Marshal(msgtype, data)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// Marshal serialises data to ipc message of msgtype, compressed if Compression decides so.
+// Compressed flag in the header is set only if compression reduced the size.
+func (e Encoder) Marshal(msgtype ReqType, data *K) ([]byte, error) {
+	if err := checkCapability(data, e.Capability); err != nil {
+		return nil, err
+	}
+	var order = e.Order
+	if order == nil {
+		order = binary.LittleEndian
+	}
 	buf := new(bytes.Buffer)
 
 	// As a place holder header, write 8 bytes to the buffer
 	header := [8]byte{}
 	if _, err := buf.Write(header[:]); err != nil {
-		return err
+		return nil, err
 	}
 
 	// Then write the qipc encoded data
-	if err := writeData(buf, order, data); err != nil {
-		return err
+	if err := e.writeData(buf, order, data); err != nil {
+		return nil, err
+	}
+
+	var size = int64(buf.Len())
+	if size > largeMessageSize && !e.wide {
+		if e.Capability < CapabilityLarge {
+			return nil, ErrTooLarge
+		}
+		// vector lengths of large messages take 8 bytes
+		e.wide = true
+		return e.Marshal(msgtype, data)
+	}
+	if size > maxMessageSize {
+		return nil, ErrTooLarge
 	}
 
 	// Now that we have the length of the buffer, create the correct header
 	header[0] = 1 // byte order
+	if order == binary.BigEndian {
+		header[0] = 0
+	}
 	header[1] = byte(msgtype)
 	header[2] = 0
-	header[3] = 0
-	order.PutUint32(header[4:], uint32(buf.Len()))
+	header[3] = byte(size >> 32) // bits 32-39 of the size of large message
+	order.PutUint32(header[4:], uint32(size))
 
 	// Write the correct header to the original buffer
 	b := buf.Bytes()
 	copy(b, header[:])
 
-	_, err := w.Write(Compress(b))
-	return err
+	// compression is not supported by v2.5 and for large messages
+	raw := len(b)
+	if e.Capability > CapabilityV25 && !e.wide && (e.Compression == nil || e.Compression(raw, e.Local)) {
+		b = Compress(b)
+	}
+	if e.Stats != nil {
+		e.Stats.add(raw, len(b))
+	}
+	return b, nil
 }
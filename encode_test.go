@@ -1,8 +1,11 @@
 package kdb
 
 import (
+	"bufio"
 	"bytes"
-	"errors"
+	"encoding/binary"
+	"math"
+	"reflect"
 	"time"
 	//"fmt"
 	"github.com/nu7hatch/gouuid"
@@ -27,7 +30,7 @@ var encodingTests = []struct {
 	{"`a`b!2 3", NewDict(SymbolV([]string{"a", "b"}), IntV([]int32{2, 3})), DictWithAtomsBytes},
 	{"{x+y} in .d", NewFunc("d", "{x+y}"), FuncNonRootBytes},
 	{"{x+y}", NewFunc("", "{x+y}"), FuncBytes},
-	{"'type", Error(errors.New("type")), ErrorBytes},
+	{"'type", Error(QError("type")), ErrorBytes},
 	{"(\"ac\";`b;`)", NewList(&K{KC, NONE, "ac"}, Symbol("b"), Symbol("")), GenericList2Bytes},
 	{"`byte$enlist til 5", NewList([]*K{{KG, NONE, []byte{0, 1, 2, 3, 4}}}...), GeneralListBytes},
 	{"([]a:enlist 2;b:enlist 3)", NewTable([]string{"a", "b"},
@@ -42,16 +45,23 @@ var encodingTests = []struct {
 	{"1#21:53:37.963", &K{KT, NONE, []int32{78817963}}, TimeVecBytes},
 	{"21:22:01 + 1 2", &K{KV, NONE, []int32{76922, 76923}}, SecondVecBytes},
 	{"21:22*til 2", &K{KU, NONE, []int32{0, 1282}}, MinuteVecBytes},
+	{"1#2013.06.10 as Date", DateV([]Date{NewDate(DateAsTime)}), DateVecBytes},
+	{"1#2013.06.10 from time.Time", DateV(NewDates([]time.Time{DateAsTime})), DateVecBytes},
+	{"1#21:53:37.963 as Time", &K{KT, NONE, []Time{NewTime(21*time.Hour + 53*time.Minute + 37963*time.Millisecond)}}, TimeVecBytes},
+	{"21:22:01 + 1 2 as Second", &K{KV, NONE, []Second{NewSecond(76922 * time.Second), NewSecond(76923 * time.Second)}}, SecondVecBytes},
+	{"21:22*til 2 as Minute", &K{KU, NONE, []Minute{NewMinute(0), NewMinute(1282 * time.Minute)}}, MinuteVecBytes},
 	{"2013.06m +til 3", &K{KM, NONE, []Month{161, 162, 163}}, MonthVecBytes},
 	{"2018.01.26D01:49:00.884361000", &K{-KP, NONE, TimestampAsTime}, TimestampAsBytes},
 	{"2#2018.01.26D01:49:00.884361000", &K{KP, NONE, []time.Time{TimestampAsTime, TimestampAsTime}}, TimestampVectorAsBytes},
 	{"8c6b8b64-6815-6084-0a3e-178401251b68", &K{-UU, NONE, uuid.UUID{0x8c, 0x6b, 0x8b, 0x64, 0x68, 0x15, 0x60, 0x84, 0x0a, 0x3e, 0x17, 0x84, 0x01, 0x25, 0x1b, 0x68}}, GUIDBytes},
 	{"0x0 sv/: 16 cut `byte$til 32", &K{UU, NONE, []uuid.UUID{{0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f}, {0x10, 0x11, 0x12, 0x13, 0x14, 0x15, 0x16, 0x17, 0x18, 0x19, 0x1a, 0x1b, 0x1c, 0x1d, 0x1e, 0x1f}}}, GUIDVecBytes},
 	{"0D01:22:33.444555666*1+til 2", &K{KN, NONE, []time.Duration{4953444555666, 9906889111332}}, TimespanVecBytes},
+	{"0D01:22:33.444555666*1+til 2 as Timespan", &K{KN, NONE, []Timespan{4953444555666, 9906889111332}}, TimespanVecBytes},
 	{"`s#`a`b!2 3", &K{XD, SORTED, Dict{&K{KS, SORTED, []string{"a", "b"}}, IntV([]int32{2, 3})}}, SortedDictBytes},
 	{"`s#([]a:enlist 2;b:enlist 3)", &K{XT, SORTED, Table{[]string{"a", "b"}, []*K{{KI, PARTED, []int32{2}}, IntV([]int32{3})}}}, SortedTableBytes},
 	{"-8!sums", &K{KSCAN, NONE, &K{KFUNCBP, NONE, byte(1)}}, []byte{0x01, 0x00, 0x00, 0x00, 0x0b, 0x00, 0x00, 0x00, 0x6c, 0x66, 0x01}},
-	{"-8!2000.01.01", Date(time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)), []byte{0x01, 0x00, 0x00, 0x00, 0x0d, 0x00, 0x00, 0x00, 0xf2, 0x00, 0x00, 0x00, 0x00}},
+	{"-8!2000.01.01", &K{-KD, NONE, time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)}, []byte{0x01, 0x00, 0x00, 0x00, 0x0d, 0x00, 0x00, 0x00, 0xf2, 0x00, 0x00, 0x00, 0x00}},
+	{"-8!2000.01.01 as Date", DateAtom(time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)), []byte{0x01, 0x00, 0x00, 0x00, 0x0d, 0x00, 0x00, 0x00, 0xf2, 0x00, 0x00, 0x00, 0x00}},
 	{"-8!(\"ab\"@0x40\\:)", &K{KCOMP, NONE, []*K{{KPROJ, NONE, []*K{{KFUNCBP, NONE, uint8(18)}, {KC, NONE, "ab"}}}, {KEACHLEFT, NONE, &K{-KG, NONE, byte(0x40)}}}}, []byte{0x01, 0x00, 0x00, 0x00, 0x1f, 0x00, 0x00, 0x00, 0x69, 0x02, 0x00, 0x00, 0x00, 0x68, 0x02, 0x00, 0x00, 0x00, 0x66, 0x12, 0x0a, 0x00, 0x02, 0x00, 0x00, 0x00, 0x61, 0x62, 0x6f, 0xfc, 0x40}},
 }
 
@@ -72,6 +82,103 @@ func TestEncoding(t *testing.T) {
 	}
 }
 
+var roundtripTests = []struct {
+	desc  string
+	input *K
+	// nan values are never equal so only re-encoded bytes are compared
+	nan bool
+}{
+	{"booleans", &K{KB, NONE, []bool{true, false}}, false},
+	{"boolean", &K{-KB, NONE, true}, false},
+	{"guid", &K{-UU, NONE, uuid.UUID{1, 2, 3}}, false},
+	{"guids", &K{UU, NONE, []uuid.UUID{{1}, {}}}, false},
+	{"byte", &K{-KG, NONE, byte(0xff)}, false},
+	{"bytes", &K{KG, NONE, []byte{0, 0xff}}, false},
+	{"shorts", &K{KH, NONE, []int16{1, Nh, Wh, -Wh}}, false},
+	{"short null", &K{-KH, NONE, Nh}, false},
+	{"short infinity", &K{-KH, NONE, -Wh}, false},
+	{"ints", IntV([]int32{1, Ni, Wi, -Wi}), false},
+	{"int null", Int(Ni), false},
+	{"longs", LongV([]int64{1, Nj, Wj, -Wj}), false},
+	{"long infinity", Long(Wj), false},
+	{"reals", RealV([]float32{1.5, float32(math.Inf(1)), float32(math.Inf(-1))}), false},
+	{"real null", Real(float32(math.NaN())), true},
+	{"floats", FloatV([]float64{1.5, math.Inf(1), math.Inf(-1)}), false},
+	{"float nulls", FloatV([]float64{math.NaN(), 1}), true},
+	{"char", &K{-KC, NONE, byte('a')}, false},
+	{"string", &K{KC, NONE, "abc"}, false},
+	{"sorted string", &K{KC, SORTED, "abc"}, false},
+	{"empty string", &K{KC, NONE, ""}, false},
+	{"symbol", Symbol("abc"), false},
+	{"null symbol", Symbol(""), false},
+	{"grouped symbols", &K{KS, GROUPED, []string{"a", "", "a"}}, false},
+	{"timestamp", &K{-KP, NONE, TimestampAsTime}, false},
+	{"timestamps", &K{KP, NONE, []time.Time{TimestampAsTime, NullTime, InfTime, NegInfTime}}, false},
+	{"month", &K{-KM, NONE, Month(161)}, false},
+	{"months", &K{KM, NONE, []Month{161, Month(Ni), Month(Wi)}}, false},
+	{"date", &K{-KD, NONE, NewDate(DateAsTime)}, false},
+	{"date before epoch", &K{-KD, NONE, NewDate(time.Date(1999, 12, 31, 0, 0, 0, 0, time.UTC))}, false},
+	{"dates", DateV([]Date{NewDate(DateAsTime), Date(NullTime), Date(InfTime), Date(NegInfTime)}), false},
+	{"datetime", &K{-KZ, NONE, DatetimeAsTime}, false},
+	{"datetime null", &K{-KZ, NONE, NullTime}, false},
+	{"datetime infinity", &K{-KZ, NONE, NegInfTime}, false},
+	{"raw datetime", &K{-KZ, NONE, math.NaN()}, true},
+	{"datetimes", &K{KZ, NONE, []time.Time{DatetimeAsTime, NullTime, InfTime}}, false},
+	{"timespan", &K{-KN, NONE, Timespan(Nj)}, false},
+	{"timespans", &K{KN, NONE, []Timespan{Timespan(time.Second), Timespan(Nj), Timespan(Wj)}}, false},
+	{"minute", &K{-KU, NONE, NewMinute(1282 * time.Minute)}, false},
+	{"minutes", &K{KU, NONE, []Minute{NewMinute(21*time.Hour + 22*time.Minute), Minute(NullTime), Minute(InfTime)}}, false},
+	{"second", &K{-KV, NONE, Second(NullTime)}, false},
+	{"seconds", &K{KV, NONE, []Second{NewSecond(-time.Second), Second(time.Date(2000, 1, 1, 21, 22, 1, 0, time.UTC))}}, false},
+	{"time", &K{-KT, NONE, NewTime(78817963 * time.Millisecond)}, false},
+	{"time infinity", &K{-KT, NONE, Time(NegInfTime)}, false},
+	{"times", &K{KT, NONE, []Time{Time(time.Date(2000, 1, 1, 21, 53, 37, 963000000, time.UTC))}}, false},
+	{"empty longs", LongV([]int64{}), false},
+	{"empty list", &K{K0, NONE, []*K{}}, false},
+	{"general list", NewList(Long(1), Symbol("a"), NewList(&K{KC, NONE, "b"})), false},
+	{"dict", NewDict(SymbolV([]string{"a", "b"}), NewList(Long(1), FloatV([]float64{2}))), false},
+	{"sorted dict", &K{XD, SORTED, Dict{&K{KS, SORTED, []string{"a", "b"}}, IntV([]int32{2, 3})}}, false},
+	{"table", NewTable([]string{"sym", "time"}, []*K{SymbolV([]string{"a"}), {KP, NONE, []time.Time{TimestampAsTime}}}), false},
+	{"keyed table", NewDict(NewTable([]string{"a"}, []*K{IntV([]int32{2})}), NewTable([]string{"b"}, []*K{IntV([]int32{3})})), false},
+	{"function", NewFunc("d", "{x+y}"), false},
+	{"identity", identity, false},
+	{"composition", &K{KCOMP, NONE, []*K{{KPROJ, NONE, []*K{{KFUNCBP, NONE, uint8(18)}, {KC, NONE, "ab"}}}, {KEACHLEFT, NONE, &K{-KG, NONE, byte(0x40)}}}}, false},
+	{"compressed", LongV(make([]int64, 1000)), false},
+}
+
+func TestRoundtrip(t *testing.T) {
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		e := Encoder{Capability: DefaultCapability, Order: order}
+		for _, tt := range roundtripTests {
+			b, err := e.Marshal(SYNC, tt.input)
+			if err != nil {
+				t.Errorf("Encoding '%s' failed: %v", tt.desc, err)
+				continue
+			}
+			res, _, err := Decode(bufio.NewReader(bytes.NewReader(b)))
+			if err != nil {
+				t.Errorf("Decoding '%s' failed: %v", tt.desc, err)
+				continue
+			}
+			if tt.nan {
+				if b2, err := e.Marshal(SYNC, res); err != nil || !bytes.Equal(b, b2) {
+					t.Errorf("Roundtrip of '%s' failed expected/got: \n%v\n%v\n", tt.desc, b, b2)
+				}
+			} else if !reflect.DeepEqual(res, tt.input) {
+				t.Errorf("Roundtrip of '%s' failed expected/got: \n%#v\n%#v\n", tt.desc, tt.input, res)
+			}
+		}
+	}
+}
+
+func TestEncodeInvalidData(t *testing.T) {
+	for _, k := range []*K{{-KJ, NONE, int32(1)}, {KJ, NONE, []int32{1}}, {KD, NONE, int32(1)}, {KC, NONE, 1}} {
+		if err := Encode(new(bytes.Buffer), ASYNC, k); err == nil {
+			t.Errorf("Encoding %T as type %d should fail", k.Data, k.Type)
+		}
+	}
+}
+
 func BenchmarkEncodeAll(b *testing.B) {
 	buf := new(bytes.Buffer)
 
@@ -86,3 +193,122 @@ func BenchmarkEncodeAll(b *testing.B) {
 		}
 	}
 }
+
+var capabilityTests = []struct {
+	desc       string
+	input      *K
+	capability byte
+	supported  bool
+}{
+	{"guid v3.0", &K{-UU, NONE, uuid.UUID{}}, CapabilityV30, true},
+	{"guid v2.6", &K{-UU, NONE, uuid.UUID{}}, CapabilityV26, false},
+	{"guid vector v2.6", &K{UU, NONE, []uuid.UUID{}}, 2, false},
+	{"timestamp v2.6", &K{-KP, NONE, TimestampAsTime}, CapabilityV26, true},
+	{"timestamp v2.5", &K{-KP, NONE, TimestampAsTime}, CapabilityV25, false},
+	{"timespan vector v2.5", &K{KN, NONE, []time.Duration{1}}, CapabilityV25, false},
+	{"nested timespan v2.5", NewList(Int(1), NewList(&K{-KN, NONE, time.Duration(1)})), CapabilityV25, false},
+	{"dict with guid values v2.6", NewDict(SymbolV([]string{"a"}), &K{UU, NONE, []uuid.UUID{{}}}), CapabilityV26, false},
+	{"table with timestamp column v2.5", NewTable([]string{"a"}, []*K{{KP, NONE, []time.Time{TimestampAsTime}}}), CapabilityV25, false},
+	{"table with int column v2.5", NewTable([]string{"a"}, []*K{IntV([]int32{1})}), CapabilityV25, true},
+}
+
+func TestEncodeCapability(t *testing.T) {
+	for _, tt := range capabilityTests {
+		buf := new(bytes.Buffer)
+		err := Encoder{Capability: tt.capability}.Encode(buf, ASYNC, tt.input)
+		if tt.supported && err != nil {
+			t.Errorf("Encoding '%s' failed: %s", tt.desc, err)
+		}
+		if !tt.supported {
+			if _, ok := err.(*CapabilityError); !ok {
+				t.Errorf("Encoding '%s' should fail with capability error, got %v", tt.desc, err)
+			}
+		}
+	}
+}
+
+func TestEncodeNoCompressionV25(t *testing.T) {
+	true2K := &K{KB, NONE, make([]bool, 2000)}
+	buf := new(bytes.Buffer)
+	if err := (Encoder{Capability: CapabilityV25}).Encode(buf, ASYNC, true2K); err != nil {
+		t.Fatal("Encoding failed", err)
+	}
+	if b := buf.Bytes(); b[2] != 0 || len(b) != 2014 {
+		t.Error("Message for v2.5 peer should not be compressed")
+	}
+}
+
+func TestEncoderCompression(t *testing.T) {
+	true2K := &K{KB, NONE, make([]bool, 2000)}
+	tests := []struct {
+		desc       string
+		policy     CompressionPolicy
+		local      bool
+		input      *K
+		compressed bool
+	}{
+		{"always", nil, false, true2K, true},
+		{"never", CompressNever, false, true2K, false},
+		{"default remote", CompressDefault, false, true2K, true},
+		{"default local", CompressDefault, true, true2K, false},
+		{"default small", CompressDefault, false, &K{KB, NONE, make([]bool, 1000)}, false},
+		{"custom", func(size int, local bool) bool { return size > 1000 }, true, &K{KB, NONE, make([]bool, 1000)}, true},
+	}
+	for _, tt := range tests {
+		stats := new(CompressionStats)
+		b, err := Encoder{Capability: DefaultCapability, Compression: tt.policy, Local: tt.local, Stats: stats}.Marshal(ASYNC, tt.input)
+		if err != nil {
+			t.Fatal("Encoding failed", err)
+		}
+		if compressed := b[2] == 1; compressed != tt.compressed {
+			t.Errorf("%s: expected compressed %v, got %v", tt.desc, tt.compressed, compressed)
+		}
+		size := 14 + int64(tt.input.Len())
+		if stats.Messages() != 1 || stats.Size() != size || stats.Sent() != int64(len(b)) || stats.Saved() != size-int64(len(b)) {
+			t.Errorf("%s: unexpected stats %+v", tt.desc, *stats)
+		}
+		if tt.compressed != (stats.Compressed() == 1) {
+			t.Errorf("%s: compressed message was not counted", tt.desc)
+		}
+	}
+}
+
+func TestEncodeLargeMessage(t *testing.T) {
+	defer func(size int64) { largeMessageSize = size }(largeMessageSize)
+	largeMessageSize = 100
+	input := NewList(LongV(make([]int64, 20)), SymbolV([]string{"a", "b"}), Int(1))
+
+	buf := new(bytes.Buffer)
+	if err := (Encoder{Capability: CapabilityV30}).Encode(buf, ASYNC, input); err != ErrTooLarge {
+		t.Error("Expected message to be too large for v3.0 peer, got", err)
+	}
+	buf.Reset()
+	if err := (Encoder{Capability: CapabilityLarge}).Encode(buf, ASYNC, input); err != nil {
+		t.Fatal("Encoding large message failed", err)
+	}
+	b := buf.Bytes()
+	// 8 byte header, list type, attr and 8 byte length, long vector type, attr and 8 byte length
+	if len(b) != 8+2+8+2+8+20*8+2+8+4+5 {
+		t.Errorf("Large message should use 8 byte vector lengths, got %v", b)
+	}
+	if b[2] != 0 {
+		t.Error("Large message should not be compressed")
+	}
+	res, _, err := Decode(bufio.NewReader(buf))
+	if err != nil {
+		t.Fatal("Decoding large message failed", err)
+	}
+	if !reflect.DeepEqual(res, input) {
+		t.Errorf("Roundtrip failed expected/got: \n%v\n%v\n", input, res)
+	}
+}
+
+func TestLargeHeaderSize(t *testing.T) {
+	h := ipcHeader{ByteOrder: 1, Reserved: 0x01, MsgSize: 0x10}
+	if h.size() != 1<<32+0x10 {
+		t.Error("Unexpected size of large message", h.size())
+	}
+	if h.Compressed = 1; h.ok() {
+		t.Error("Large message cannot be compressed")
+	}
+}
@@ -1,7 +1,10 @@
 package kdb_test
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
+	"time"
 
 	"github.com/sv/kdbgo"
 )
@@ -19,3 +22,30 @@ func ExampleDialKDB() {
 	}
 	fmt.Println("Result:", res)
 }
+
+func ExampleDial() {
+	con, err := kdb.Dial(context.Background(), "localhost:1234",
+		kdb.WithCredentials("user", "password"),
+		kdb.WithTLS(&tls.Config{}),
+		kdb.WithConnectTimeout(5*time.Second))
+	if err != nil {
+		fmt.Println("Failed to connect:", err)
+		return
+	}
+
+	res, err := con.Call("til", kdb.Int(10))
+	if err != nil {
+		fmt.Println("Query failed:", err)
+	}
+	fmt.Println("Result:", res)
+}
+
+func ExampleRegistry() {
+	r := kdb.NewRegistry()
+	r.Register("add", func(a, b int64) int64 { return a + b })
+	// call from q as h(`add;1;2)
+	s := &kdb.Server{Handler: r}
+	if err := s.ListenAndServe(":1234"); err != nil {
+		fmt.Println("Server failed:", err)
+	}
+}
@@ -1,3 +1,5 @@
 module github.com/sv/kdbgo
 
+go 1.20
+
 require github.com/nu7hatch/gouuid v0.0.0-20131221200532-179d4d0c4d8d
@@ -0,0 +1,365 @@
+package kdb
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"path"
+	"sync"
+	"time"
+)
+
+// httpMethods are request lines recognised when sniffing first bytes of a connection
+var httpMethods = []string{"GET ", "POST ", "HEAD ", "PUT ", "DELETE ", "OPTIONS "}
+
+// isHTTP reports whether connection starts with HTTP request line.
+// q handshake is terminated by 0 so it can never look like one.
+func isHTTP(r *bufio.Reader) bool {
+	for n := 1; ; n++ {
+		b, err := r.Peek(n)
+		if err != nil || b[n-1] == 0 {
+			return false
+		}
+		prefix := false
+		for _, m := range httpMethods {
+			if m == string(b) {
+				return true
+			}
+			if len(m) > n && m[:n] == string(b) {
+				prefix = true
+			}
+		}
+		if !prefix {
+			return false
+		}
+	}
+}
+
+// serveHTTP passes conn to HTTP server shared by all connections and waits until it is closed
+func (s *Server) serveHTTP(conn net.Conn) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	if s.http == nil {
+		s.httpConns = &connListener{conns: make(chan net.Conn), done: make(chan struct{})}
+		timeout := s.handshakeTimeout()
+		s.http = &http.Server{
+			Handler:           http.HandlerFunc(s.routeHTTP),
+			ErrorLog:          s.ErrorLog,
+			ReadHeaderTimeout: timeout,
+			IdleTimeout:       timeout,
+		}
+		go s.http.Serve(s.httpConns)
+	}
+	l := s.httpConns
+	s.mu.Unlock()
+	c := &notifyConn{Conn: conn, done: make(chan struct{})}
+	select {
+	case l.conns <- c:
+		<-c.done
+	case <-l.done:
+	}
+}
+
+// routeHTTP sends WebSocket upgrade requests to WebSocketHandler and everything else to HTTPHandler
+func (s *Server) routeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case headerHasToken(r.Header, "Upgrade", "websocket"):
+		s.WebSocketHandler().ServeHTTP(w, r)
+	case s.HTTPHandler != nil:
+		s.HTTPHandler.ServeHTTP(w, r)
+	default:
+		s.QueryHandler().ServeHTTP(w, r)
+	}
+}
+
+// QueryHandler returns http.Handler evaluating queries by Handler as synchronous requests, like .z.ph and .z.pp in q.
+// Query is taken from URL query of GET request, e.g. /.json?select from trade, or from body of POST request.
+// Handler receives it as a string with ServerConn of the client, which cannot be sent other messages.
+// Result is formatted according to URL path: /.csv, /.json or /.txt, the latter is also used for other paths.
+// Clients are authenticated by Authenticator using HTTP basic authentication.
+func (s *Server) QueryHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, _ := r.BasicAuth()
+		if s.Authenticator != nil {
+			if err := s.Authenticator.Authenticate(r.Context(), user, password); err != nil {
+				w.Header().Set("WWW-Authenticate", `Basic realm="kdb"`)
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		var query string
+		switch r.Method {
+		case "GET", "HEAD":
+			q, err := url.PathUnescape(r.URL.RawQuery)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			query = q
+		case "POST":
+			b, err := io.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			query = string(b)
+		default:
+			w.Header().Set("Allow", "GET, HEAD, POST")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		ctx := context.WithValue(r.Context(), userKey{}, user)
+		c := &ServerConn{user: user}
+		if ap, err := netip.ParseAddrPort(r.RemoteAddr); err == nil {
+			c.addr = net.TCPAddrFromAddrPort(ap)
+		}
+		res, err := s.handle(ctx, c, SYNC, &K{KC, NONE, query})
+		if err != nil {
+			http.Error(w, "'"+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if res == nil {
+			res = identity
+		}
+		var buf bytes.Buffer
+		switch path.Ext(r.URL.Path) {
+		case ".csv":
+			w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+			err = writeCSV(&buf, res)
+		case ".json":
+			w.Header().Set("Content-Type", "application/json")
+			err = json.NewEncoder(&buf).Encode(jsonValue(res))
+		default:
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			buf.WriteString(res.String())
+			buf.WriteByte('\n')
+		}
+		if err != nil {
+			http.Error(w, "'"+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write(buf.Bytes())
+	})
+}
+
+// jsonValue converts k to value marshalled the same way as .j.j does:
+// tables to arrays of objects, dicts to objects and lists to arrays
+func jsonValue(k *K) interface{} {
+	switch k.Type {
+	case XT:
+		t := k.Data.(Table)
+		rows := []interface{}{}
+		if len(t.Data) > 0 {
+			rows = make([]interface{}, t.Data[0].Len())
+		}
+		for i := range rows {
+			rows[i] = jsonValue(&K{XD, NONE, t.Index(i)})
+		}
+		return rows
+	case XD:
+		d := k.Data.(Dict)
+		if d.Key.Type == XT && d.Value.Type == XT {
+			return jsonValue(unkey(d))
+		}
+		obj := make(jsonObject, d.Key.Len())
+		for i := range obj {
+			obj[i].key = fmt.Sprint(textValue(item(d.Key, i)))
+			obj[i].value = jsonValue(item(d.Value, i))
+		}
+		return obj
+	case KC:
+		return k.Data.(string)
+	case -KC:
+		return string(k.Data.(byte))
+	}
+	if k.Type >= K0 && k.Type <= KT {
+		list := make([]interface{}, k.Len())
+		for i := range list {
+			list[i] = jsonValue(item(k, i))
+		}
+		return list
+	}
+	if k.Type < K0 {
+		switch x := k.Data.(type) {
+		case float64:
+			if math.IsNaN(x) || math.IsInf(x, 0) {
+				return nil
+			}
+			return x
+		case float32:
+			if math.IsNaN(float64(x)) || math.IsInf(float64(x), 0) {
+				return nil
+			}
+			return x
+		case bool, int16, int32, int64, byte:
+			return x
+		}
+		return textValue(k)
+	}
+	return k.String()
+}
+
+// jsonObject is marshalled as JSON object preserving order of keys
+type jsonObject []struct {
+	key   string
+	value interface{}
+}
+
+func (o jsonObject) MarshalJSON() ([]byte, error) {
+	buf := []byte{'{'}
+	for i, kv := range o {
+		if i > 0 {
+			buf = append(buf, ',')
+		}
+		k, err := json.Marshal(kv.key)
+		if err != nil {
+			return nil, err
+		}
+		v, err := json.Marshal(kv.value)
+		if err != nil {
+			return nil, err
+		}
+		buf = append(append(append(buf, k...), ':'), v...)
+	}
+	return append(buf, '}'), nil
+}
+
+// writeCSV writes table with header, keyed tables are unkeyed, other values are written one per line
+func writeCSV(w io.Writer, k *K) error {
+	if k.Type == XD {
+		if d := k.Data.(Dict); d.Key.Type == XT && d.Value.Type == XT {
+			k = unkey(d)
+		}
+	}
+	cw := csv.NewWriter(w)
+	switch {
+	case k.Type == XT:
+		t := k.Data.(Table)
+		cw.Write(t.Columns)
+		n := 0
+		if len(t.Data) > 0 {
+			n = t.Data[0].Len()
+		}
+		row := make([]string, len(t.Columns))
+		for i := 0; i < n; i++ {
+			for j, col := range t.Data {
+				row[j] = fmt.Sprint(textValue(item(col, i)))
+			}
+			cw.Write(row)
+		}
+	case k.Type >= K0 && k.Type < KC || k.Type > KC && k.Type <= KT:
+		for i := 0; i < k.Len(); i++ {
+			cw.Write([]string{fmt.Sprint(textValue(item(k, i)))})
+		}
+	default:
+		cw.Write([]string{fmt.Sprint(textValue(k))})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// unkey joins key and value columns of keyed table
+func unkey(d Dict) *K {
+	kt, vt := d.Key.Data.(Table), d.Value.Data.(Table)
+	cols := append(append([]string{}, kt.Columns...), vt.Columns...)
+	data := append(append([]*K{}, kt.Data...), vt.Data...)
+	return NewTable(cols, data)
+}
+
+// item returns i'th element of list k as K
+func item(k *K, i int) *K {
+	x := k.Index(i)
+	if e, ok := x.(*K); ok {
+		return e
+	}
+	if e, ok := x.(Dict); ok {
+		return &K{XD, NONE, e}
+	}
+	return &K{-k.Type, NONE, x}
+}
+
+// textValue formats atom k, temporal values use ISO 8601 like .j.j does and null times are empty
+func textValue(k *K) interface{} {
+	if k.Type >= K0 {
+		return k.String()
+	}
+	switch v := k.Data.(type) {
+	case time.Time:
+		if v.IsZero() {
+			return ""
+		}
+		switch k.Type {
+		case -KD:
+			return v.UTC().Format("2006-01-02")
+		case -KZ:
+			return v.UTC().Format("2006-01-02T15:04:05.000")
+		}
+		return v.UTC().Format("2006-01-02T15:04:05.000000000")
+	case Date:
+		if time.Time(v).IsZero() {
+			return ""
+		}
+		return time.Time(v).Format("2006-01-02")
+	case fmt.Stringer:
+		return v.String()
+	}
+	return k.Data
+}
+
+// connListener hands over connections accepted elsewhere to http.Server
+type connListener struct {
+	conns chan net.Conn
+	once  sync.Once
+	done  chan struct{}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, ErrServerClosed
+	}
+}
+
+func (l *connListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr { return streamAddr{} }
+
+// peekedConn reads through buffer holding bytes peeked while sniffing protocol
+type peekedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *peekedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// notifyConn signals when connection is closed
+type notifyConn struct {
+	net.Conn
+	once sync.Once
+	done chan struct{}
+}
+
+func (c *notifyConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() { close(c.done) })
+	return err
+}
@@ -0,0 +1,128 @@
+package kdb
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// queryServer serves IPC, HTTP and WebSocket on the same port answering queries with a fixed table
+func queryServer(t *testing.T) int {
+	trades := NewTable([]string{"sym", "price", "time"}, []*K{
+		SymbolV([]string{"AAPL", "MSFT"}),
+		FloatV([]float64{1.5, 2}),
+		{KP, NONE, []time.Time{time.Date(2024, 1, 2, 10, 0, 0, 0, time.UTC), time.Date(2024, 1, 3, 10, 0, 0, 0, time.UTC)}},
+	})
+	_, port := serveTCP(t, &Server{
+		Handler: HandlerFunc(func(ctx context.Context, c *ServerConn, msgtype ReqType, data *K) (*K, error) {
+			if user, _ := UserFromContext(ctx); user != "user" || c.User() != user || c.RemoteAddr() == nil {
+				return nil, errors.New("user")
+			}
+			var query string
+			switch data.Type {
+			case KC:
+				query = data.Data.(string)
+			case K0:
+				query = data.Data.([]*K)[0].Data.(string)
+			}
+			if query != "select from trade" {
+				return nil, errors.New("query")
+			}
+			return trades, nil
+		}),
+		Authenticator: AuthenticatorFunc(func(ctx context.Context, user, password string) error {
+			if password != "pwd" {
+				return ErrAuthFailed
+			}
+			return nil
+		}),
+	})
+	return port
+}
+
+func httpGet(t *testing.T, port int, path, query string) (int, string) {
+	req, err := http.NewRequest("GET", "http://localhost:"+strconv.Itoa(port)+path+"?"+escapeQuery(query), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("user", "pwd")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal("HTTP request failed:", err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal("Failed to read response:", err)
+	}
+	return resp.StatusCode, string(b)
+}
+
+func TestServerHTTP(t *testing.T) {
+	port := queryServer(t)
+	tests := []struct {
+		path, expected string
+	}{
+		{"/.csv", "sym,price,time\nAAPL,1.5,2024-01-02T10:00:00.000000000\nMSFT,2,2024-01-03T10:00:00.000000000\n"},
+		{"/.json", `[{"sym":"AAPL","price":1.5,"time":"2024-01-02T10:00:00.000000000"},{"sym":"MSFT","price":2,"time":"2024-01-03T10:00:00.000000000"}]` + "\n"},
+		{"/.txt", "+[sym price time]!([AAPL MSFT];[1.5 2];[2024-01-02 10:00:00 +0000 UTC 2024-01-03 10:00:00 +0000 UTC])\n"},
+	}
+	for _, tt := range tests {
+		code, body := httpGet(t, port, tt.path, "select from trade")
+		if code != http.StatusOK || body != tt.expected {
+			t.Errorf("GET %s returned %d %q, expected %q", tt.path, code, body, tt.expected)
+		}
+	}
+	if code, body := httpGet(t, port, "/.csv", "select from quote"); code != http.StatusBadRequest || body != "'query\n" {
+		t.Errorf("Expected query error, got %d %q", code, body)
+	}
+
+	resp, err := http.Post("http://localhost:"+strconv.Itoa(port)+"/.csv", "text/plain", strings.NewReader("select from trade"))
+	if err != nil {
+		t.Fatal("HTTP request failed:", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Error("Expected unauthorized response, got", resp.Status)
+	}
+
+	// IPC and WebSocket on the same port
+	con, err := DialKDB("localhost", port, "user:pwd")
+	if err != nil {
+		t.Fatal("Failed to connect:", err)
+	}
+	defer con.Close()
+	if res, err := con.Call("select from trade"); err != nil || res.Type != XT {
+		t.Error("IPC query failed", res, err)
+	}
+	ws, err := DialWebSocket(context.Background(), "ws://localhost:"+strconv.Itoa(port)+"/", WithAuth("user:pwd"))
+	if err != nil {
+		t.Fatal("Failed to connect over WebSocket:", err)
+	}
+	defer ws.Close()
+	if res, err := ws.Call("select from trade"); err != nil || res.Type != XT {
+		t.Error("WebSocket query failed", res, err)
+	}
+}
+
+func TestHTTPHeaderTimeout(t *testing.T) {
+	_, port := serveTCP(t, &Server{Handler: echoHandler(nil), HandshakeTimeout: 50 * time.Millisecond})
+	conn, err := net.Dial("tcp", "localhost:"+strconv.Itoa(port))
+	if err != nil {
+		t.Fatal("Failed to connect:", err)
+	}
+	defer conn.Close()
+	if _, err = conn.Write([]byte("GET /")); err != nil {
+		t.Fatal("Failed to write:", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err = io.Copy(io.Discard, conn); err != nil {
+		t.Error("Stalled HTTP request should be closed by server, got", err)
+	}
+}
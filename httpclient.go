@@ -0,0 +1,346 @@
+package kdb
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HTTPClient queries q process over its HTTP port, the same way a browser requesting
+// http://host:port/.csv?select from t does. Results are parsed into tables with column types inferred.
+type HTTPClient struct {
+	// URL of q HTTP port, e.g. http://host:5000 or https://host:5000
+	URL string
+	// JSON requests results formatted by .j.j instead of CSV
+	JSON   bool
+	client *http.Client
+	opts   []DialOption
+}
+
+// NewHTTPClient creates client for q HTTP port at url s.
+// Credentials, TLS, connect and handshake timeouts and keep-alive are taken from opts as for Dial.
+// Credentials are sent using HTTP basic authentication and are obtained again for every query.
+func NewHTTPClient(s string, opts ...DialOption) (*HTTPClient, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, errors.New("Unsupported URL scheme " + u.Scheme)
+	}
+	cfg := dialConfig{handshakeTimeout: defaultHandshakeTimeout}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	d := &net.Dialer{Timeout: cfg.connectTimeout, KeepAlive: cfg.keepAlive}
+	return &HTTPClient{
+		URL: strings.TrimSuffix(s, "/"),
+		client: &http.Client{Transport: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			DialContext:         d.DialContext,
+			TLSClientConfig:     cfg.tls,
+			TLSHandshakeTimeout: cfg.handshakeTimeout,
+		}},
+		opts: opts,
+	}, nil
+}
+
+// Query evaluates query and returns resulting table. q errors are returned as QError.
+func (c *HTTPClient) Query(ctx context.Context, query string) (Table, error) {
+	cfg, err := newDialConfig(ctx, c.opts)
+	if err != nil {
+		return Table{}, err
+	}
+	format := "/.csv?"
+	if c.JSON {
+		format = "/.json?"
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", c.URL+format+escapeQuery(query), nil)
+	if err != nil {
+		return Table{}, err
+	}
+	if cfg.auth != "" {
+		user, password := cfg.auth, ""
+		if i := strings.IndexByte(cfg.auth, ':'); i >= 0 {
+			user, password = cfg.auth[:i], cfg.auth[i+1:]
+		}
+		req.SetBasicAuth(user, password)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return Table{}, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return Table{}, ErrAuthFailed
+	default:
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		if msg := strings.TrimSpace(string(b)); strings.HasPrefix(msg, "'") {
+			return Table{}, QError(msg[1:])
+		}
+		return Table{}, errors.New("HTTP query failed: " + resp.Status)
+	}
+	if c.JSON {
+		return parseJSONTable(resp.Body)
+	}
+	return parseCSVTable(resp.Body)
+}
+
+// escapeQuery percent-encodes query for URL, + is escaped too as q does not decode it as space
+func escapeQuery(query string) string {
+	return strings.ReplaceAll(url.PathEscape(query), "+", "%2B")
+}
+
+// parseCSVTable reads table with header row
+func parseCSVTable(r io.Reader) (Table, error) {
+	rows, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return Table{}, err
+	}
+	if len(rows) == 0 {
+		return Table{}, errors.New("Missing CSV header")
+	}
+	t := Table{Columns: rows[0], Data: make([]*K, len(rows[0]))}
+	cells := make([]string, len(rows)-1)
+	for j := range t.Columns {
+		for i, row := range rows[1:] {
+			cells[i] = row[j]
+		}
+		t.Data[j] = inferColumn(cells, KJ, KF, KP, KD, KB, KS)
+	}
+	return t, nil
+}
+
+// parseJSONTable reads array of objects produced by .j.j for table, keeping order of columns
+func parseJSONTable(r io.Reader) (Table, error) {
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	if err := expectDelim(dec, '['); err != nil {
+		return Table{}, err
+	}
+	var t Table
+	var cols [][]interface{}
+	index := make(map[string]int)
+	rows := 0
+	for dec.More() {
+		var keys []string
+		var values []interface{}
+		if err := expectDelim(dec, '{'); err != nil {
+			return Table{}, err
+		}
+		for dec.More() {
+			tok, err := dec.Token()
+			if err != nil {
+				return Table{}, err
+			}
+			var v interface{}
+			if err = dec.Decode(&v); err != nil {
+				return Table{}, err
+			}
+			keys, values = append(keys, tok.(string)), append(values, v)
+		}
+		if _, err := dec.Token(); err != nil {
+			return Table{}, err
+		}
+		for i, key := range keys {
+			j, ok := index[key]
+			if !ok {
+				j = len(t.Columns)
+				index[key] = j
+				t.Columns = append(t.Columns, key)
+				cols = append(cols, make([]interface{}, rows))
+			}
+			cols[j] = append(cols[j], values[i])
+		}
+		rows++
+		for j := range cols {
+			if len(cols[j]) < rows {
+				cols[j] = append(cols[j], nil)
+			}
+		}
+	}
+	if _, err := dec.Token(); err != nil {
+		return Table{}, err
+	}
+	t.Data = make([]*K, len(cols))
+	for j, col := range cols {
+		t.Data[j] = jsonColumn(col)
+	}
+	return t, nil
+}
+
+// expectDelim reads JSON delimiter d
+func expectDelim(dec *json.Decoder, d json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok != d {
+		return errors.New("Result is not a table")
+	}
+	return nil
+}
+
+// jsonColumn infers type of column from JSON values, strings are never converted to numbers
+func jsonColumn(col []interface{}) *K {
+	cells := make([]string, len(col))
+	kind := ""
+	for i, v := range col {
+		var k string
+		switch x := v.(type) {
+		case nil:
+			continue
+		case json.Number:
+			cells[i], k = x.String(), "number"
+		case bool:
+			cells[i], k = strconv.FormatBool(x), "bool"
+		case string:
+			cells[i], k = x, "string"
+		default:
+			return generalColumn(col)
+		}
+		if kind != "" && kind != k {
+			return generalColumn(col)
+		}
+		kind = k
+	}
+	switch kind {
+	case "number":
+		return inferColumn(cells, KJ, KF)
+	case "bool":
+		return inferColumn(cells, KB)
+	}
+	return inferColumn(cells, KP, KD, KS)
+}
+
+// generalColumn keeps mixed JSON values as general list of strings
+func generalColumn(col []interface{}) *K {
+	list := make([]*K, len(col))
+	for i, v := range col {
+		b, _ := json.Marshal(v)
+		list[i] = &K{KC, NONE, string(b)}
+	}
+	return &K{K0, NONE, list}
+}
+
+// timestampLayouts are formats of timestamps produced by q and .j.j
+var timestampLayouts = []string{"2006.01.02D15:04:05.999999999", "2006-01-02T15:04:05.999999999"}
+
+// dateLayouts are formats of dates produced by q and .j.j
+var dateLayouts = []string{"2006.01.02", "2006-01-02"}
+
+// inferColumn converts cells to vector of the first of types all non-empty cells can be parsed as.
+// Empty cells become nulls. Column is symbol if no other type fits.
+func inferColumn(cells []string, types ...int8) *K {
+	empty := true
+	for _, s := range cells {
+		if s != "" {
+			empty = false
+			break
+		}
+	}
+	for _, typ := range types {
+		if empty && typ != KS {
+			continue
+		}
+		if data, ok := parseColumn(typ, cells); ok {
+			return &K{typ, NONE, data}
+		}
+	}
+	return &K{KS, NONE, append([]string{}, cells...)}
+}
+
+// parseColumn parses every cell as type typ
+func parseColumn(typ int8, cells []string) (interface{}, bool) {
+	switch typ {
+	case KB:
+		// q writes booleans to CSV as 1 and 0, which are read as longs, so only true and false are recognised
+		v := make([]bool, len(cells))
+		for i, s := range cells {
+			switch s {
+			case "true":
+				v[i] = true
+			case "false":
+			default:
+				return nil, false
+			}
+		}
+		return v, true
+	case KJ:
+		v := make([]int64, len(cells))
+		for i, s := range cells {
+			if s == "" {
+				v[i] = math.MinInt64
+				continue
+			}
+			x, err := strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				return nil, false
+			}
+			v[i] = x
+		}
+		return v, true
+	case KF:
+		v := make([]float64, len(cells))
+		for i, s := range cells {
+			if s == "" {
+				v[i] = math.NaN()
+				continue
+			}
+			x, err := strconv.ParseFloat(s, 64)
+			if err != nil {
+				return nil, false
+			}
+			v[i] = x
+		}
+		return v, true
+	case KP, KD:
+		layouts := timestampLayouts
+		if typ == KD {
+			layouts = dateLayouts
+		}
+		v := make([]time.Time, len(cells))
+		for i, s := range cells {
+			if s == "" {
+				continue
+			}
+			x, ok := parseTime(layouts, s)
+			if !ok {
+				return nil, false
+			}
+			v[i] = x
+		}
+		if typ == KD {
+			dates := make([]Date, len(v))
+			for i, t := range v {
+				dates[i] = Date(t)
+			}
+			return dates, true
+		}
+		return v, true
+	case KS:
+		return append([]string{}, cells...), true
+	}
+	return nil, false
+}
+
+// parseTime parses s using the first matching layout
+func parseTime(layouts []string, s string) (time.Time, bool) {
+	for _, layout := range layouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,78 @@
+package kdb
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHTTPClient(t *testing.T) {
+	port := queryServer(t)
+	url := "http://localhost:" + strconv.Itoa(port)
+	for _, json := range []bool{false, true} {
+		c, err := NewHTTPClient(url, WithAuth("user:pwd"), WithConnectTimeout(time.Second))
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.JSON = json
+		tbl, err := c.Query(context.Background(), "select from trade")
+		if err != nil {
+			t.Fatal("Query failed:", err)
+		}
+		if strings.Join(tbl.Columns, ",") != "sym,price,time" || tbl.Data[0].Type != KS || tbl.Data[1].Type != KF || tbl.Data[2].Type != KP {
+			t.Errorf("Unexpected table (json %v): %v", json, tbl)
+			continue
+		}
+		if ts := tbl.Data[2].Data.([]time.Time)[1]; !ts.Equal(time.Date(2024, 1, 3, 10, 0, 0, 0, time.UTC)) {
+			t.Error("Unexpected timestamp", ts)
+		}
+		if _, err = c.Query(context.Background(), "select from quote"); err != QError("query") {
+			t.Error("Expected q error, got", err)
+		}
+	}
+	c, err := NewHTTPClient(url, WithCredentials("user", "wrong"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.Query(context.Background(), "select from trade"); err != ErrAuthFailed {
+		t.Error("Expected authentication failure, got", err)
+	}
+}
+
+func TestParseCSVTable(t *testing.T) {
+	tbl, err := parseCSVTable(strings.NewReader("sym,size,date,time,empty,flag,ok\n" +
+		"AAPL,100,2024.01.02,2024.01.02D10:00:00.000000000,,1,true\n" +
+		"MSFT,,2024.01.03,,,0,false\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	types := []int8{KS, KJ, KD, KP, KS, KJ, KB}
+	for i, col := range tbl.Data {
+		if col.Type != types[i] || col.Len() != 2 {
+			t.Errorf("Column %s has type %d, expected %d", tbl.Columns[i], col.Type, types[i])
+		}
+	}
+	if size := tbl.Data[1].Data.([]int64); size[0] != 100 || size[1] != math.MinInt64 {
+		t.Error("Expected null for empty long", size)
+	}
+	if ts := tbl.Data[3].Data.([]time.Time)[0]; !ts.Equal(time.Date(2024, 1, 2, 10, 0, 0, 0, time.UTC)) {
+		t.Error("Unexpected timestamp", ts)
+	}
+	if flag := tbl.Data[5].Data.([]int64); flag[0] != 1 || flag[1] != 0 {
+		t.Error("Expected 0/1 column as longs", flag)
+	}
+	if ok := tbl.Data[6].Data.([]bool); !ok[0] || ok[1] {
+		t.Error("Unexpected booleans", ok)
+	}
+	// select count i from t
+	tbl, err = parseCSVTable(strings.NewReader("x\n1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if x, ok := tbl.Data[0].Data.([]int64); !ok || len(x) != 1 || x[0] != 1 {
+		t.Error("Expected count as long, got", tbl.Data[0])
+	}
+}
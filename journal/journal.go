@@ -0,0 +1,310 @@
+// Package journal reads and writes kdb+ tickerplant log files.
+//
+// Log file is a q list of serialised messages, usually (`upd;`table;data), appended one by one.
+// It can be replayed in q with -11!file.
+package journal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/sv/kdbgo"
+)
+
+// ErrCorrupt indicates incomplete or corrupt data after the valid entries of the log
+var ErrCorrupt = errors.New("Journal is corrupt")
+
+// ErrBadHeader indicates that file is not a q list file
+var ErrBadHeader = errors.New("Journal header is invalid")
+
+// header of empty generic list file written by .[file;();:;()]. Last 4 bytes hold number of entries.
+var header = [8]byte{0xff, 0x01, 0x00, 0x00, 0, 0, 0, 0}
+
+const headerSize = int64(len(header))
+
+// Journal appends entries to a log file
+type Journal struct {
+	mu    sync.Mutex
+	f     *os.File
+	count int64
+}
+
+// Create creates empty log file, truncating existing one
+func Create(path string) (*Journal, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = f.Write(header[:]); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &Journal{f: f}, nil
+}
+
+// Open opens log file for appending, creating it if it does not exist.
+// ErrCorrupt is returned if the log has corrupt tail, see Truncate.
+func Open(path string) (*Journal, error) {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return Create(path)
+	}
+	count, size, err := Count(path)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = f.Seek(size, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &Journal{f: f, count: count}, nil
+}
+
+// Append writes data to the end of the log
+func (j *Journal) Append(data *kdb.K) error {
+	var buf bytes.Buffer
+	if err := kdb.EncodeData(&buf, data); err != nil {
+		return err
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, err := j.f.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	j.count++
+	var n [4]byte
+	binary.LittleEndian.PutUint32(n[:], uint32(j.count))
+	_, err := j.f.WriteAt(n[:], 4)
+	return err
+}
+
+// Upd appends (`upd;`table;data) entry
+func (j *Journal) Upd(table string, data *kdb.K) error {
+	return j.Append(kdb.NewList(kdb.Symbol("upd"), kdb.Symbol(table), data))
+}
+
+// Count returns number of entries in the log
+func (j *Journal) Count() int64 {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.count
+}
+
+// Name returns path of the log file
+func (j *Journal) Name() string {
+	return j.f.Name()
+}
+
+// Sync commits written entries to stable storage
+func (j *Journal) Sync() error {
+	return j.f.Sync()
+}
+
+// Close closes the log file
+func (j *Journal) Close() error {
+	return j.f.Close()
+}
+
+// Reader reads entries of a log
+type Reader struct {
+	r     *bufio.Reader
+	cr    *countingReader
+	count int64
+	off   int64
+	// f is the log file if known, its size bounds entries so that corrupt lengths cannot exhaust memory
+	f statter
+}
+
+type statter interface {
+	Stat() (os.FileInfo, error)
+}
+
+// allocRatio bounds memory allocated for decoded entry relative to its serialised size
+const allocRatio = 64
+
+// countingReader counts bytes read from r
+type countingReader struct {
+	r   io.Reader
+	n   int64
+	err error // first error of r other than io.EOF
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	if err != nil && err != io.EOF && c.err == nil {
+		c.err = err
+	}
+	return n, err
+}
+
+// NewReader reads log header from r and returns reader of the entries.
+// If r is a file, entries cannot be larger than the rest of the file.
+func NewReader(r io.Reader) (*Reader, error) {
+	cr := &countingReader{r: r}
+	jr := &Reader{r: bufio.NewReader(cr), cr: cr}
+	if f, ok := r.(statter); ok {
+		if fi, err := f.Stat(); err == nil && fi.Mode().IsRegular() {
+			jr.f = f
+		}
+	}
+	var h [8]byte
+	if _, err := io.ReadFull(jr.r, h[:]); err != nil {
+		return nil, jr.readErr(ErrBadHeader)
+	}
+	if !bytes.Equal(h[:4], header[:4]) {
+		return nil, ErrBadHeader
+	}
+	jr.off = headerSize
+	return jr, nil
+}
+
+// Next returns next entry. It returns io.EOF at the end of the log
+// and ErrCorrupt if the rest of the log cannot be decoded. Errors reading the log are wrapped.
+func (r *Reader) Next() (*kdb.K, error) {
+	if _, err := r.r.Peek(1); err == io.EOF {
+		return nil, io.EOF
+	}
+	var opts kdb.DecodeOptions
+	if r.f != nil {
+		// log may grow while it is read
+		fi, err := r.f.Stat()
+		if err != nil {
+			return nil, err
+		}
+		left := fi.Size() - r.off
+		if left <= 0 {
+			return nil, ErrCorrupt
+		}
+		opts = kdb.DecodeOptions{MaxVectorLength: int(left), MaxAlloc: left * allocRatio}
+	}
+	data, err := opts.DecodeData(r.r)
+	if err != nil {
+		return nil, r.readErr(ErrCorrupt)
+	}
+	r.count++
+	r.off = r.cr.n - int64(r.r.Buffered())
+	return data, nil
+}
+
+// readErr returns error of the underlying reader if reading failed, otherwise err
+func (r *Reader) readErr(err error) error {
+	if r.cr.err != nil {
+		return fmt.Errorf("Failed to read journal: %w", r.cr.err)
+	}
+	return err
+}
+
+// Count returns number of entries read so far
+func (r *Reader) Count() int64 {
+	return r.count
+}
+
+// Offset returns size in bytes of the header and entries read so far
+func (r *Reader) Offset() int64 {
+	return r.off
+}
+
+// Count returns number of valid entries in the log at path and size of the valid part in bytes, like -11!(-2;file).
+// ErrCorrupt is returned along with them if the log has corrupt tail.
+func Count(path string) (chunks, size int64, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	r, err := NewReader(f)
+	if err != nil {
+		return 0, 0, err
+	}
+	for {
+		if _, err = r.Next(); err != nil {
+			break
+		}
+	}
+	if err == io.EOF {
+		err = nil
+	}
+	return r.Count(), r.Offset(), err
+}
+
+// Truncate removes corrupt tail of the log at path and returns number of entries kept
+func Truncate(path string) (int64, error) {
+	chunks, size, err := Count(path)
+	if err != ErrCorrupt {
+		return chunks, err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	if err = f.Truncate(size); err != nil {
+		return 0, err
+	}
+	var n [4]byte
+	binary.LittleEndian.PutUint32(n[:], uint32(chunks))
+	if _, err = f.WriteAt(n[:], 4); err != nil {
+		return 0, err
+	}
+	return chunks, f.Sync()
+}
+
+// Replay calls upd for every (`upd;`table;data) entry of the log at path, like -11!file.
+// Other entries are skipped. It returns number of entries read.
+// Valid entries are replayed before ErrCorrupt is returned for corrupt tail.
+func Replay(path string, upd func(table string, data *kdb.K) error) (int64, error) {
+	return ReplayN(path, -1, upd)
+}
+
+// ReplayN replays at most n entries like -11!(n;file). All entries are replayed if n is negative.
+func ReplayN(path string, n int64, upd func(table string, data *kdb.K) error) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	r, err := NewReader(f)
+	if err != nil {
+		return 0, err
+	}
+	for n < 0 || r.Count() < n {
+		data, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return r.Count(), err
+		}
+		if table, x, ok := parseUpd(data); ok {
+			if err = upd(table, x); err != nil {
+				return r.Count(), err
+			}
+		}
+	}
+	return r.Count(), nil
+}
+
+// parseUpd splits (`upd;`table;data) or (`.u.upd;`table;data) into table and data
+func parseUpd(data *kdb.K) (string, *kdb.K, bool) {
+	if data.Type != kdb.K0 {
+		return "", nil, false
+	}
+	list := data.Data.([]*kdb.K)
+	if len(list) != 3 || list[0].Type != -kdb.KS || list[1].Type != -kdb.KS {
+		return "", nil, false
+	}
+	if fn := list[0].Data.(string); fn != "upd" && fn != ".u.upd" {
+		return "", nil, false
+	}
+	return list[1].Data.(string), list[2], true
+}
@@ -0,0 +1,192 @@
+package journal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/sv/kdbgo"
+)
+
+func testJournal(t *testing.T) string {
+	path := filepath.Join(t.TempDir(), "sym2024.01.02")
+	j, err := Create(path)
+	if err != nil {
+		t.Fatal("Failed to create journal:", err)
+	}
+	defer j.Close()
+	for i := int64(0); i < 3; i++ {
+		if err = j.Upd("trade", kdb.NewList(kdb.Symbol("AAPL"), kdb.Long(i))); err != nil {
+			t.Fatal("Failed to append:", err)
+		}
+	}
+	if err = j.Append(kdb.NewList(kdb.Symbol("other"), kdb.Long(0))); err != nil {
+		t.Fatal("Failed to append:", err)
+	}
+	if j.Count() != 4 {
+		t.Error("Unexpected count", j.Count())
+	}
+	return path
+}
+
+func TestJournalFormat(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "log")
+	j, err := Create(path)
+	if err != nil {
+		t.Fatal("Failed to create journal:", err)
+	}
+	if err = j.Upd("t", kdb.Long(1)); err != nil {
+		t.Fatal("Failed to append:", err)
+	}
+	j.Close()
+	// `:log set (); h:hopen `:log; h enlist(`upd;`t;1)
+	expected := []byte{0xff, 0x01, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x03, 0x00, 0x00, 0x00,
+		0xf5, 'u', 'p', 'd', 0x00,
+		0xf5, 't', 0x00,
+		0xf9, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, expected) {
+		t.Errorf("Unexpected journal content\nexpected %x\ngot      %x", expected, b)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	path := testJournal(t)
+	var got []int64
+	n, err := Replay(path, func(table string, data *kdb.K) error {
+		if table != "trade" {
+			t.Error("Unexpected table", table)
+		}
+		got = append(got, data.Data.([]*kdb.K)[1].Data.(int64))
+		return nil
+	})
+	if err != nil || n != 4 {
+		t.Error("Replay failed", n, err)
+	}
+	if !reflect.DeepEqual(got, []int64{0, 1, 2}) {
+		t.Error("Unexpected entries replayed", got)
+	}
+	got = nil
+	if n, err = ReplayN(path, 2, func(table string, data *kdb.K) error {
+		got = append(got, data.Data.([]*kdb.K)[1].Data.(int64))
+		return nil
+	}); err != nil || n != 2 || len(got) != 2 {
+		t.Error("Partial replay failed", n, got, err)
+	}
+}
+
+func TestCorruptTail(t *testing.T) {
+	path := testJournal(t)
+	_, valid, err := Count(path)
+	if err != nil {
+		t.Fatal("Count failed:", err)
+	}
+	var buf bytes.Buffer
+	kdb.EncodeData(&buf, kdb.NewList(kdb.Symbol("upd"), kdb.Symbol("trade"), kdb.LongV([]int64{1, 2, 3})))
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(buf.Bytes()[:buf.Len()-5])
+	f.Close()
+
+	chunks, size, err := Count(path)
+	if err != ErrCorrupt || chunks != 4 || size != valid {
+		t.Errorf("Expected corrupt log with 4 chunks and %d bytes, got %d, %d, %v", valid, chunks, size, err)
+	}
+	if _, err = Open(path); err != ErrCorrupt {
+		t.Error("Opening corrupt log should fail, got", err)
+	}
+	if n, err := Replay(path, func(string, *kdb.K) error { return nil }); err != ErrCorrupt || n != 4 {
+		t.Error("Replay should stop at corrupt tail", n, err)
+	}
+	if chunks, err = Truncate(path); err != nil || chunks != 4 {
+		t.Fatal("Truncate failed", chunks, err)
+	}
+	j, err := Open(path)
+	if err != nil {
+		t.Fatal("Failed to open truncated log:", err)
+	}
+	if err = j.Upd("trade", kdb.Long(5)); err != nil {
+		t.Fatal("Failed to append:", err)
+	}
+	j.Close()
+	if chunks, _, err = Count(path); err != nil || chunks != 5 {
+		t.Error("Unexpected count after append", chunks, err)
+	}
+}
+
+func TestCorruptLength(t *testing.T) {
+	path := testJournal(t)
+	_, valid, err := Count(path)
+	if err != nil {
+		t.Fatal("Count failed:", err)
+	}
+	// (`upd;`trade;long vector) claiming 2 billion elements
+	var buf bytes.Buffer
+	kdb.EncodeData(&buf, kdb.NewList(kdb.Symbol("upd"), kdb.Symbol("trade"), kdb.LongV([]int64{1})))
+	b := buf.Bytes()
+	binary.LittleEndian.PutUint32(b[len(b)-12:], 0x7fffffff)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(b)
+	f.Close()
+
+	chunks, size, err := Count(path)
+	if err != ErrCorrupt || chunks != 4 || size != valid {
+		t.Errorf("Expected corrupt log with 4 chunks and %d bytes, got %d, %d, %v", valid, chunks, size, err)
+	}
+}
+
+// failingReader returns err once b is read
+type failingReader struct {
+	b   []byte
+	err error
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if len(r.b) == 0 {
+		return 0, r.err
+	}
+	n := copy(p, r.b)
+	r.b = r.b[n:]
+	return n, nil
+}
+
+func TestReadError(t *testing.T) {
+	b, err := os.ReadFile(testJournal(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	diskErr := errors.New("disk failure")
+	r, err := NewReader(&failingReader{b[:len(b)-5], diskErr})
+	if err != nil {
+		t.Fatal("Failed to read header:", err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err = r.Next(); err != nil {
+			t.Fatal("Failed to read entry:", err)
+		}
+	}
+	if _, err = r.Next(); err == ErrCorrupt || !errors.Is(err, diskErr) {
+		t.Error("Expected read error, got", err)
+	}
+}
+
+func TestBadHeader(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notalog")
+	os.WriteFile(path, []byte("hello world"), 0644)
+	if _, _, err := Count(path); err != ErrBadHeader {
+		t.Error("Expected bad header, got", err)
+	}
+}
@@ -3,27 +3,60 @@ package kdb
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
 	"net"
-	"runtime"
+	"strconv"
+	"sync"
 	"time"
 )
 
+// IPC capabilities negotiated during handshake
 // 0 - v2.5, no compression, no timestamp, no timespan, no uuid
 // 1..2 - v2.6-2.8, compression, timestamp, timespan
 // 3 - v3.0, compression, timestamp, timespan, uuid
-//
+// 6 - v3.6, messages over 2GB with vectors over 2 billion items
+const (
+	CapabilityV25   byte = 0
+	CapabilityV26   byte = 1
+	CapabilityV30   byte = 3
+	CapabilityLarge byte = 6
+)
+
+// DefaultCapability is requested during handshake unless configured otherwise
+const DefaultCapability = CapabilityLarge
 
-// KDBConn establishes connection and communicates using Q IPC protocol
+// KDBConn establishes connection and communicates using Q IPC protocol.
+// It is safe for concurrent use. Each message is written atomically and synchronous
+// calls are serialised so every call receives its own response. Asynchronous messages
+// do not wait for pending synchronous calls to complete.
 type KDBConn struct {
 	con     net.Conn
 	rbuf    *bufio.Reader
 	Host    string
 	Port    string
 	userpwd string
+	// capability agreed during handshake
+	capability byte
+	// local is set when peer runs on the same host
+	local bool
+	// compress decides whether outgoing message should be compressed, CompressDefault if nil
+	compress CompressionPolicy
+	stats    *CompressionStats
+	wmu      sync.Mutex    // serialises writes
+	rsem     chan struct{} // serialises request/response pairs and reads, see lock
+	emu      sync.Mutex    // guards ioerr
+	ioerr    error         // first I/O error, connection is unusable afterwards
+	// redial opens new connection with the same parameters
+	redial func(ctx context.Context) (*KDBConn, error)
+}
+
+// Capability returns IPC capability agreed with the server during handshake
+func (c *KDBConn) Capability() byte {
+	return c.capability
 }
 
 // Close connection to the server
@@ -38,173 +71,241 @@ func (c *KDBConn) ok() bool {
 	return c.con != nil
 }
 
-// process clients requests
-func HandleClientConnection(conn net.Conn) {
-	c := conn.(*net.TCPConn)
-	c.SetKeepAlive(true)
-	c.SetNoDelay(true)
-	var cred = make([]byte, 100)
-	n, err := c.Read(cred)
-	if err != nil {
-		conn.Close()
-		return
-	}
-	c.Write(cred[n-2 : n-1])
-	rbuf := bufio.NewReaderSize(conn, 4*1024*1024)
-	i := 0
-	for {
-		_, msgtype, err := Decode(rbuf)
-
-		if err == io.EOF {
-			conn.Close()
-			return
-		}
-		if msgtype == SYNC {
-			Encode(conn, RESPONSE, Error(ErrSyncRequest))
-		}
-		// don't respond
-		i++
+// failed records err unless it is an error returned by q.
+// Returns err for convenience.
+func (c *KDBConn) failed(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(QError); ok {
+		return err
+	}
+	c.emu.Lock()
+	if c.ioerr == nil {
+		c.ioerr = err
 	}
+	c.emu.Unlock()
+	return err
+}
+
+// broken returns the first I/O error seen on the connection
+func (c *KDBConn) broken() error {
+	c.emu.Lock()
+	defer c.emu.Unlock()
+	return c.ioerr
+}
+
+// Ping checks the connection by sending empty synchronous request
+func (c *KDBConn) Ping(ctx context.Context) error {
+	_, err := c.CallContext(ctx, "::")
+	return err
+}
+
+// HandleClientConnection serves client connection discarding all messages
+// and replying to synchronous requests with ErrSyncRequest. Use Server to process messages.
+func HandleClientConnection(conn net.Conn) {
+	new(Server).ServeConn(conn)
 }
 
 // Call performs synchronous call to kdb+ similar to h(func;arg1;arg2;...)
 func (c *KDBConn) Call(cmd string, args ...*K) (data *K, err error) {
+	return c.CallContext(context.Background(), cmd, args...)
+}
+
+// CallContext performs synchronous call to kdb+ like Call, bounded by ctx.
+// Deadline of ctx is applied to the underlying connection and cancellation aborts pending read.
+// If ctx is done before the response has been read completely the connection is closed,
+// as the rest of the response cannot be reliably skipped, and ctx.Err() is returned.
+func (c *KDBConn) CallContext(ctx context.Context, cmd string, args ...*K) (data *K, err error) {
 	if !c.ok() {
 		return nil, errors.New("Closed connection")
 	}
-	var sending *K
-	var cmdK = &K{KC, NONE, cmd}
-	if len(args) == 0 {
-		sending = cmdK
-	} else {
-		sending = &K{K0, NONE, append([]*K{cmdK}, args...)}
+	if err = ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err = c.lock(ctx); err != nil {
+		return nil, err
 	}
-	err = Encode(c.con, SYNC, sending)
+	defer c.unlock()
+	err = c.write(ctx, SYNC, callMessage(cmd, args))
 	if err != nil {
 		return nil, err
 	}
+	stop := c.watch(ctx, c.con.SetReadDeadline)
 	data, _, err = Decode(c.rbuf)
-	return data, err
+	if err = c.failed(stop(err)); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// lock waits for pending call or read to complete unless ctx is done first
+func (c *KDBConn) lock(ctx context.Context) error {
+	select {
+	case c.rsem <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *KDBConn) unlock() {
+	<-c.rsem
 }
 
 // AsyncCall performs asynchronous call to kdb+
 func (c *KDBConn) AsyncCall(cmd string, args ...*K) (err error) {
+	return c.AsyncCallContext(context.Background(), cmd, args...)
+}
+
+// AsyncCallContext performs asynchronous call to kdb+ like AsyncCall, bounded by ctx.
+// If ctx is done before the message has been written the connection is closed
+// and ctx.Err() is returned.
+func (c *KDBConn) AsyncCallContext(ctx context.Context, cmd string, args ...*K) (err error) {
 	if !c.ok() {
 		return errors.New("Closed connection")
 	}
-	var sending *K
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+	return c.write(ctx, ASYNC, callMessage(cmd, args))
+}
+
+// write encodes single message and sends it while holding write lock
+func (c *KDBConn) write(ctx context.Context, msgtype ReqType, data *K) error {
+	b, err := c.encoder().Marshal(msgtype, data)
+	if err != nil {
+		return err
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	stop := c.watch(ctx, c.con.SetWriteDeadline)
+	_, err = c.con.Write(b)
+	return c.failed(stop(err))
+}
+
+// encoder returns Encoder applying compression policy of the connection
+func (c *KDBConn) encoder() Encoder {
+	e := Encoder{Capability: c.capability, Compression: c.compress, Local: c.local, Stats: c.stats}
+	if e.Compression == nil {
+		e.Compression = CompressDefault
+	}
+	return e
+}
+
+// callMessage builds message for h(func;arg1;arg2;...) style calls
+func callMessage(cmd string, args []*K) *K {
 	var cmdK = &K{KC, NONE, cmd}
 	if len(args) == 0 {
-		sending = cmdK
-	} else {
-		sending = &K{K0, NONE, append([]*K{cmdK}, args...)}
+		return cmdK
+	}
+	return &K{K0, NONE, append([]*K{cmdK}, args...)}
+}
+
+// aLongTimeAgo is a deadline in the past used to abort pending I/O
+var aLongTimeAgo = time.Unix(1, 0)
+
+// watch applies ctx deadline using setDeadline and aborts pending I/O once ctx is done.
+// Returned function must be called with the result of the I/O. It restores the connection
+// deadline and, if ctx was done before I/O completed, closes connection and returns ctx.Err().
+func (c *KDBConn) watch(ctx context.Context, setDeadline func(time.Time) error) func(error) error {
+	if ctx.Done() == nil {
+		return func(err error) error { return err }
+	}
+	if d, ok := ctx.Deadline(); ok {
+		setDeadline(d)
+	}
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			setDeadline(aLongTimeAgo)
+		case <-done:
+		}
+	}()
+	return func(err error) error {
+		close(done)
+		<-stopped
+		setDeadline(time.Time{})
+		if err == nil {
+			return nil
+		}
+		if d, ok := ctx.Deadline(); ok && !time.Now().Before(d) {
+			// connection deadline may fire just before ctx notices it
+			<-ctx.Done()
+		}
+		if ctx.Err() != nil {
+			c.con.Close()
+			return ctx.Err()
+		}
+		return err
 	}
-	return Encode(c.con, ASYNC, sending)
 }
 
 // Response sends response to asynchronous call
 func (c *KDBConn) Response(data *K) (err error) {
-	return Encode(c.con, RESPONSE, data)
+	return c.write(context.Background(), RESPONSE, data)
 }
 
 // ReadMessage reads complete message from connection
 func (c *KDBConn) ReadMessage() (data *K, msgtype ReqType, e error) {
-	return Decode(c.rbuf)
+	c.lock(context.Background())
+	defer c.unlock()
+	data, msgtype, e = Decode(c.rbuf)
+	return data, msgtype, c.failed(e)
 }
 
 // WriteMessage sends data in Q IPC format
 func (c *KDBConn) WriteMessage(msgtype ReqType, data *K) (err error) {
-	return Encode(c.con, msgtype, data)
+	return c.write(context.Background(), msgtype, data)
 }
 
 // DialKDB connects to host:port using supplied user:password. Wait until connected
 func DialKDB(host string, port int, auth string) (*KDBConn, error) {
-	var timeout time.Duration
-	return DialKDBTimeout(host, port, auth, timeout)
+	return Dial(context.Background(), net.JoinHostPort(host, strconv.Itoa(port)), WithAuth(auth))
 }
 
-func kdbHandshake(c net.Conn, auth string) error {
-	// handshake - assuming latest protocol
+// kdbHandshake sends credentials and requested capability and returns capability agreed by the server.
+// q closes connection without reply if credentials are rejected.
+func kdbHandshake(c net.Conn, auth string, capability byte) (byte, error) {
 	var buf = bytes.NewBufferString(auth)
-	// capabilities
-	// 3 - uuid/etc
-	buf.WriteByte(3)
+	buf.WriteByte(capability)
 	buf.WriteByte(0)
 	_, err := c.Write(buf.Bytes())
 	if err != nil {
 		c.Close()
-		return err
+		return 0, err
+	}
+	var reply [1]byte
+	_, err = io.ReadFull(c, reply[:])
+	if err == io.EOF {
+		c.Close()
+		return 0, ErrAuthFailed
 	}
-	var reply = make([]byte, 2+len(auth))
-	n, err := c.Read(reply)
 	if err != nil {
 		c.Close()
-		return err
+		return 0, err
 	}
-	if n != 1 {
+	if reply[0] > capability {
 		c.Close()
-		return errors.New("Authentication error. Max supported version - " + string(reply[0]))
+		return 0, fmt.Errorf("Server replied with capability %d, requested %d", reply[0], capability)
 	}
-	return nil
+	return reply[0], nil
 }
 
 // DialTLS connects to host:port using TLS with cfg provided
 func DialTLS(host string, port int, auth string, cfg *tls.Config) (*KDBConn, error) {
-	c, err := tls.Dial("tcp", host+":"+fmt.Sprint(port), cfg)
-	if err != nil {
-		return nil, err
-	}
-	err = kdbHandshake(c, auth)
-	if err != nil {
-		return nil, err
-	}
-	kdbconn := KDBConn{c, bufio.NewReader(c), "", string(port), auth}
-	return &kdbconn, nil
+	return Dial(context.Background(), net.JoinHostPort(host, strconv.Itoa(port)), WithAuth(auth), WithTLS(cfg))
 }
 
 // DialUnix connects to port using unix domain sockets. host parameter is ignored.
 func DialUnix(host string, port int, auth string) (*KDBConn, error) {
-	var (
-		c   net.Conn
-		err error
-	)
-
-	if runtime.GOOS == "linux" {
-		c, err = net.Dial("unix", fmt.Sprintf("@/tmp/kx.%d", port))
-	} else if runtime.GOOS == "darwin" {
-		c, err = net.Dial("unix", fmt.Sprintf("/tmp/kx.%d", port))
-	} else {
-		return nil, net.UnknownNetworkError("unix")
-	}
-
-	if err != nil {
-		return nil, err
-	}
-
-	err = kdbHandshake(c, auth)
-	if err != nil {
-		return nil, err
-	}
-	return &KDBConn{
-		con:     c,
-		rbuf:    bufio.NewReader(c),
-		Port:    string(port),
-		userpwd: auth,
-	}, nil
+	return Dial(context.Background(), net.JoinHostPort(host, strconv.Itoa(port)), WithAuth(auth), WithUnix())
 }
 
 // DialKDBTimeout connects to host:port using supplied user:password. Wait timeout for connection
 func DialKDBTimeout(host string, port int, auth string, timeout time.Duration) (*KDBConn, error) {
-	conn, err := net.DialTimeout("tcp", host+":"+fmt.Sprint(port), timeout)
-	if err != nil {
-		return nil, err
-	}
-	c := conn.(*net.TCPConn)
-	err = kdbHandshake(c, auth)
-	if err != nil {
-		return nil, err
-	}
-	_ = c.SetKeepAlive(true) // care if keepalive is failed to be set?
-	kdbconn := KDBConn{c, bufio.NewReader(c), host, fmt.Sprint(port), auth}
-	return &kdbconn, nil
+	return Dial(context.Background(), net.JoinHostPort(host, strconv.Itoa(port)), WithAuth(auth), WithConnectTimeout(timeout))
 }
@@ -1,7 +1,10 @@
 package kdb
 
 import (
+	"bufio"
+	"context"
 	"fmt"
+	"net"
 	//"reflect"
 	"crypto/tls"
 	//"io"
@@ -9,6 +12,7 @@ import (
 	"log"
 	"os"
 	"strconv"
+	"sync"
 	//"io/ioutil"
 	"os/exec"
 	"testing"
@@ -236,6 +240,324 @@ func TestResponse(t *testing.T) {
 	}
 }
 
+// mockServer listens on random port and passes every accepted connection
+// to serve after completing q handshake
+func mockServer(t *testing.T, serve func(net.Conn)) int {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				rbuf := bufio.NewReader(conn)
+				if _, err := rbuf.ReadBytes(0); err != nil {
+					conn.Close()
+					return
+				}
+				conn.Write([]byte{3})
+				serve(&bufferedConn{conn, rbuf})
+			}()
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+// bufferedConn keeps bytes buffered during handshake
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// respondingServer responds to each sync request with result of respond
+func respondingServer(respond func(*K) *K) func(net.Conn) {
+	return func(conn net.Conn) {
+		defer conn.Close()
+		rbuf := bufio.NewReader(conn)
+		for {
+			req, msgtype, err := Decode(rbuf)
+			if err != nil {
+				return
+			}
+			if msgtype == SYNC {
+				Encode(conn, RESPONSE, respond(req))
+			}
+		}
+	}
+}
+
+// echoServer responds to each sync request with the request itself
+var echoServer = respondingServer(func(req *K) *K { return req })
+
+// silentServer reads requests and never responds
+func silentServer(conn net.Conn) {
+	defer conn.Close()
+	rbuf := bufio.NewReader(conn)
+	for {
+		if _, _, err := Decode(rbuf); err != nil {
+			return
+		}
+	}
+}
+
+func TestCallContext(t *testing.T) {
+	con, err := DialKDB("localhost", mockServer(t, echoServer), "")
+	if err != nil {
+		t.Fatalf("Failed to connect to mock server: %s", err)
+	}
+	defer con.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	res, err := con.CallContext(ctx, "echo", Long(1))
+	if err != nil {
+		t.Fatal("CallContext failed", err)
+	}
+	if res.Type != K0 || res.Len() != 2 {
+		t.Error("Unexpected result:", res)
+	}
+}
+
+func TestCallContextTimeout(t *testing.T) {
+	con, err := DialKDB("localhost", mockServer(t, silentServer), "")
+	if err != nil {
+		t.Fatalf("Failed to connect to mock server: %s", err)
+	}
+	defer con.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = con.CallContext(ctx, "hang")
+	if err != context.DeadlineExceeded {
+		t.Fatal("Expected deadline error, got", err)
+	}
+	if _, err = con.Call("1+1"); err == nil {
+		t.Error("Connection should be closed after timeout")
+	}
+}
+
+func TestCallContextQueued(t *testing.T) {
+	received := make(chan struct{}, 1)
+	port := mockServer(t, func(conn net.Conn) {
+		defer conn.Close()
+		rbuf := bufio.NewReader(conn)
+		for {
+			if _, _, err := Decode(rbuf); err != nil {
+				return
+			}
+			select {
+			case received <- struct{}{}:
+			default:
+			}
+		}
+	})
+	con, err := DialKDB("localhost", port, "")
+	if err != nil {
+		t.Fatalf("Failed to connect to mock server: %s", err)
+	}
+	defer con.Close()
+	go con.Call("hang")
+	<-received
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		_, err := con.CallContext(ctx, "1+1")
+		done <- err
+	}()
+	select {
+	case err = <-done:
+		if err != context.DeadlineExceeded {
+			t.Error("Expected deadline error, got", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Call queued behind stalled call ignored its deadline")
+	}
+}
+
+func TestCallContextCancel(t *testing.T) {
+	con, err := DialKDB("localhost", mockServer(t, silentServer), "")
+	if err != nil {
+		t.Fatalf("Failed to connect to mock server: %s", err)
+	}
+	defer con.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	_, err = con.CallContext(ctx, "hang")
+	if err != context.Canceled {
+		t.Fatal("Expected cancellation error, got", err)
+	}
+}
+
+func TestAsyncCallContext(t *testing.T) {
+	con, err := DialKDB("localhost", mockServer(t, silentServer), "")
+	if err != nil {
+		t.Fatalf("Failed to connect to mock server: %s", err)
+	}
+	defer con.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = con.AsyncCallContext(ctx, "show", Long(1))
+	if err != context.Canceled {
+		t.Fatal("Expected cancellation error, got", err)
+	}
+}
+
+func TestConcurrentCalls(t *testing.T) {
+	con, err := DialKDB("localhost", mockServer(t, echoServer), "")
+	if err != nil {
+		t.Fatalf("Failed to connect to mock server: %s", err)
+	}
+	defer con.Close()
+	var wg sync.WaitGroup
+	for g := 0; g < 16; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				id := int64(g*1000 + i)
+				if i%3 == 0 {
+					if err := con.AsyncCall("noop", Long(id)); err != nil {
+						t.Error("Async call failed", err)
+						return
+					}
+					continue
+				}
+				res, err := con.Call("echo", Long(id))
+				if err != nil {
+					t.Error("Sync call failed", err)
+					return
+				}
+				if got := res.Data.([]*K)[1].Data.(int64); got != id {
+					t.Errorf("Received response for %d instead of %d", got, id)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+}
+
+func TestAsyncDuringSyncCall(t *testing.T) {
+	slowServer := func(conn net.Conn) {
+		defer conn.Close()
+		rbuf := bufio.NewReader(conn)
+		for {
+			req, msgtype, err := Decode(rbuf)
+			if err != nil {
+				return
+			}
+			if msgtype == SYNC {
+				time.Sleep(500 * time.Millisecond)
+				Encode(conn, RESPONSE, req)
+			}
+		}
+	}
+	con, err := DialKDB("localhost", mockServer(t, slowServer), "")
+	if err != nil {
+		t.Fatalf("Failed to connect to mock server: %s", err)
+	}
+	defer con.Close()
+	done := make(chan error)
+	go func() {
+		_, err := con.Call("slow")
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	start := time.Now()
+	if err = con.AsyncCall("noop"); err != nil {
+		t.Fatal("Async call failed", err)
+	}
+	if d := time.Since(start); d > 250*time.Millisecond {
+		t.Error("Async call was blocked by pending sync call for", d)
+	}
+	if err = <-done; err != nil {
+		t.Error("Sync call failed", err)
+	}
+}
+
+// handshakeServer replies to handshake with reply and reports requested capability.
+// Connection is closed without reply if reply is empty.
+func handshakeServer(t *testing.T, reply []byte) (int, chan byte) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	requested := make(chan byte, 1)
+	go func() {
+		defer ln.Close()
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		cred, err := bufio.NewReader(conn).ReadBytes(0)
+		if err != nil {
+			return
+		}
+		requested <- cred[len(cred)-2]
+		if len(reply) > 0 {
+			conn.Write(reply)
+			silentServer(conn)
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr).Port, requested
+}
+
+func TestHandshakeCapability(t *testing.T) {
+	port, requested := handshakeServer(t, []byte{1})
+	addr := net.JoinHostPort("localhost", strconv.Itoa(port))
+	con, err := Dial(context.Background(), addr, WithCapability(3))
+	if err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+	defer con.Close()
+	if r := <-requested; r != 3 {
+		t.Error("Requested capability 3, server received", r)
+	}
+	if con.Capability() != 1 {
+		t.Error("Expected negotiated capability 1, got", con.Capability())
+	}
+}
+
+func TestHandshakeAuthFailed(t *testing.T) {
+	port, _ := handshakeServer(t, nil)
+	_, err := DialKDB("localhost", port, "user:wrong")
+	if err != ErrAuthFailed {
+		t.Error("Expected authentication error, got", err)
+	}
+}
+
+func TestHandshakeUnexpectedReply(t *testing.T) {
+	port, _ := handshakeServer(t, []byte{6})
+	addr := net.JoinHostPort("localhost", strconv.Itoa(port))
+	if _, err := Dial(context.Background(), addr, WithCapability(3)); err == nil {
+		t.Error("Capability higher than requested should be rejected")
+	}
+}
+
+func TestCallCapabilityDowngrade(t *testing.T) {
+	port, _ := handshakeServer(t, []byte{CapabilityV25})
+	con, err := DialKDB("localhost", port, "")
+	if err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+	defer con.Close()
+	err = con.AsyncCall("upd", &K{-KP, NONE, time.Now()})
+	if _, ok := err.(*CapabilityError); !ok {
+		t.Error("Expected capability error, got", err)
+	}
+	if con.broken() != nil {
+		t.Error("Connection should stay usable after rejected message")
+	}
+}
+
 func BenchmarkTradeRead(b *testing.B) {
 	con, err := DialKDB(testHost, testPort, "")
 	if err != nil {
@@ -0,0 +1,222 @@
+package kdb
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"reflect"
+	"time"
+
+	"github.com/nu7hatch/gouuid"
+)
+
+// Sentinels for null and infinite values of temporal types decoded as time.Time, Date, Minute, Second and Time,
+// e.g. 0Np, 0Wd or -0Wt. They are encoded back as q nulls and infinities.
+var (
+	NullTime   = time.Time{}
+	InfTime    = time.Unix(math.MaxInt64-62135596800, 999999999).UTC()
+	NegInfTime = time.Unix(math.MinInt64, 0).UTC()
+)
+
+// IsNull reports whether atom k is q null, e.g. 0N, 0n, ` or 0Np. Lists are never null, see IsNullAt.
+func (k *K) IsNull() bool {
+	return k.Type < K0 && isNull(k.Type, k.Data)
+}
+
+// IsInf reports whether atom k is positive or negative q infinity, e.g. 0W, -0w or 0Wp
+func (k *K) IsInf() bool {
+	return k.Type < K0 && isInf(k.Data)
+}
+
+// IsNullAt reports whether i'th element of list k is q null
+func (k *K) IsNullAt(i int) bool {
+	if e, ok := k.Index(i).(*K); ok {
+		return e.IsNull()
+	}
+	return k.Type > K0 && k.Type <= KT && isNull(-k.Type, k.Index(i))
+}
+
+// IsInfAt reports whether i'th element of list k is q infinity
+func (k *K) IsInfAt(i int) bool {
+	if e, ok := k.Index(i).(*K); ok {
+		return e.IsInf()
+	}
+	return k.Type > K0 && k.Type <= KT && isInf(k.Index(i))
+}
+
+// isNull reports whether atom x of type t is null, booleans and bytes have no null
+func isNull(t int8, x interface{}) bool {
+	switch v := x.(type) {
+	case int16:
+		return v == Nh
+	case int32:
+		return v == Ni
+	case int64:
+		return v == Nj
+	case float32:
+		return v != v
+	case float64:
+		return math.IsNaN(v)
+	case byte:
+		return t == -KC && v == ' '
+	case string:
+		return t == -KS && v == ""
+	case uuid.UUID:
+		return v == uuid.UUID{}
+	case Month:
+		return int32(v) == Ni
+	case time.Duration:
+		return int64(v) == Nj
+	case Timespan:
+		return int64(v) == Nj
+	case time.Time:
+		return v.IsZero()
+	case Date:
+		return time.Time(v).IsZero()
+	case Minute:
+		return time.Time(v).IsZero()
+	case Second:
+		return time.Time(v).IsZero()
+	case Time:
+		return time.Time(v).IsZero()
+	}
+	return false
+}
+
+// isInf reports whether atom x is positive or negative infinity
+func isInf(x interface{}) bool {
+	switch v := x.(type) {
+	case int16:
+		return v == Wh || v == -Wh
+	case int32:
+		return v == Wi || v == -Wi
+	case int64:
+		return v == Wj || v == -Wj
+	case float32:
+		return math.IsInf(float64(v), 0)
+	case float64:
+		return math.IsInf(v, 0)
+	case Month:
+		return isInf(int32(v))
+	case time.Duration:
+		return isInf(int64(v))
+	case Timespan:
+		return isInf(int64(v))
+	case time.Time:
+		return isInfTime(v)
+	case Date:
+		return isInfTime(time.Time(v))
+	case Minute:
+		return isInfTime(time.Time(v))
+	case Second:
+		return isInfTime(time.Time(v))
+	case Time:
+		return isInfTime(time.Time(v))
+	}
+	return false
+}
+
+func isInfTime(t time.Time) bool {
+	return t.Equal(InfTime) || t.Equal(NegInfTime)
+}
+
+// Nullable holds value of q type which may be null, for use as struct field or function parameter
+// receiving q values, e.g. Nullable[time.Time] for a date column with nulls
+type Nullable[T any] struct {
+	Value T
+	Valid bool
+}
+
+// Scan implements sql.Scanner. src is nil for null, other values are assigned or converted to T.
+func (n *Nullable[T]) Scan(src interface{}) error {
+	*n = Nullable[T]{}
+	if src == nil {
+		return nil
+	}
+	sv, dv := reflect.ValueOf(src), reflect.ValueOf(&n.Value).Elem()
+	switch {
+	case sv.Type().AssignableTo(dv.Type()):
+		dv.Set(sv)
+	case isNumeric(sv.Kind()) && isNumeric(dv.Kind()), sameKind(sv.Type(), dv.Type()):
+		dv.Set(sv.Convert(dv.Type()))
+	default:
+		return fmt.Errorf("cannot convert %v to %v", sv.Type(), dv.Type())
+	}
+	n.Valid = true
+	return nil
+}
+
+// scanK is implemented by Nullable, which receives q values unconverted
+func (n *Nullable[T]) scanK(k *K) error {
+	if k.IsNull() {
+		return n.Scan(nil)
+	}
+	return n.Scan(k.Data)
+}
+
+type kScanner interface {
+	scanK(k *K) error
+}
+
+var scannerType = reflect.TypeOf((*sql.Scanner)(nil)).Elem()
+
+// isNullable reports whether values of type t can receive q nulls
+func isNullable(t reflect.Type) bool {
+	return t.Kind() == reflect.Ptr || reflect.PointerTo(t).Implements(scannerType)
+}
+
+// setNullable assigns k to nullable v. Pointers are set to nil for nulls and to a new value otherwise.
+// sql.Scanner receives nil for nulls, temporal types as time.Time and chars as strings.
+func setNullable(v reflect.Value, k *K) error {
+	if v.Kind() == reflect.Ptr {
+		if k.IsNull() {
+			v.Set(reflect.Zero(v.Type()))
+			return nil
+		}
+		ev, err := fromK(k, v.Type().Elem())
+		if err != nil {
+			return err
+		}
+		p := reflect.New(v.Type().Elem())
+		p.Elem().Set(ev)
+		v.Set(p)
+		return nil
+	}
+	switch s := v.Addr().Interface().(type) {
+	case kScanner:
+		return s.scanK(k)
+	case sql.Scanner:
+		if k.IsNull() {
+			return s.Scan(nil)
+		}
+		return s.Scan(scanValue(k))
+	}
+	return nil
+}
+
+// scanValue converts atom k to value accepted by sql.Null* types
+func scanValue(k *K) interface{} {
+	switch v := k.Data.(type) {
+	case byte:
+		if k.Type == -KC {
+			return string(v)
+		}
+	case Month:
+		return int64(v)
+	case time.Duration:
+		return int64(v)
+	case Timespan:
+		return int64(v)
+	case Date:
+		return time.Time(v)
+	case Minute:
+		return time.Time(v)
+	case Second:
+		return time.Time(v)
+	case Time:
+		return time.Time(v)
+	case uuid.UUID:
+		return v.String()
+	}
+	return k.Data
+}
@@ -0,0 +1,151 @@
+package kdb
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/nu7hatch/gouuid"
+)
+
+func TestIsNull(t *testing.T) {
+	tests := []struct {
+		k         *K
+		null, inf bool
+	}{
+		{&K{-KB, NONE, false}, false, false},
+		{&K{-UU, NONE, uuid.UUID{}}, true, false},
+		{&K{-KG, NONE, byte(0)}, false, false},
+		{&K{-KH, NONE, Nh}, true, false},
+		{&K{-KH, NONE, -Wh}, false, true},
+		{Int(Ni), true, false},
+		{Int(1), false, false},
+		{Long(Wj), false, true},
+		{Real(Ne), true, false},
+		{Float(-Wf), false, true},
+		{&K{-KC, NONE, byte(' ')}, true, false},
+		{Symbol(""), true, false},
+		{&K{-KC, NONE, byte(0)}, false, false},
+		{&K{-KP, NONE, NullTime}, true, false},
+		{&K{-KP, NONE, TimestampAsTime}, false, false},
+		{&K{-KD, NONE, Date(InfTime)}, false, true},
+		{&K{-KD, NONE, Date(NullTime)}, true, false},
+		{&K{-KZ, NONE, NegInfTime}, false, true},
+		{&K{-KM, NONE, Month(Ni)}, true, false},
+		{&K{-KN, NONE, Timespan(-Wj)}, false, true},
+		{&K{-KN, NONE, Timespan(Nj)}, true, false},
+		{&K{-KU, NONE, Minute(NullTime)}, true, false},
+		{&K{-KV, NONE, Second(InfTime)}, false, true},
+		{&K{-KT, NONE, NewTime(0)}, false, false},
+		{LongV([]int64{Nj}), false, false},
+	}
+	for _, tt := range tests {
+		if tt.k.IsNull() != tt.null || tt.k.IsInf() != tt.inf {
+			t.Errorf("%#v: IsNull %v, IsInf %v, expected %v, %v", tt.k.Data, tt.k.IsNull(), tt.k.IsInf(), tt.null, tt.inf)
+		}
+	}
+	v := LongV([]int64{1, Nj, -Wj})
+	if v.IsNullAt(0) || !v.IsNullAt(1) || v.IsInfAt(1) || !v.IsInfAt(2) {
+		t.Error("Wrong nulls in vector", v)
+	}
+	if s := (&K{KC, NONE, "a b"}); s.IsNullAt(0) || !s.IsNullAt(1) {
+		t.Error("Wrong nulls in string", s)
+	}
+	if l := NewList(Long(1), Symbol("")); l.IsNullAt(0) || !l.IsNullAt(1) {
+		t.Error("Wrong nulls in list", l)
+	}
+	strs := []struct {
+		x        fmt.Stringer
+		expected string
+	}{
+		{Month(Ni), "0Nm"},
+		{Minute(NullTime), "0Nu"},
+		{Second(InfTime), "0Wv"},
+		{Time(NegInfTime), "-0Wt"},
+		{Date(NullTime), "0Nd"},
+		{Timespan(Wj), "0Wn"},
+	}
+	for _, tt := range strs {
+		if s := tt.x.String(); s != tt.expected {
+			t.Errorf("%T printed as %s, expected %s", tt.x, s, tt.expected)
+		}
+	}
+}
+
+func TestDecodeNulls(t *testing.T) {
+	// -8!(0Np;0Wp;-0Wp)
+	b, err := Encoder{}.Marshal(SYNC, &K{KJ, NONE, []int64{Nj, Wj, -Wj}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[8] = byte(KP)
+	res, _, err := Decode(bufio.NewReader(bytes.NewReader(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ts := res.Data.([]time.Time); ts[0] != NullTime || ts[1] != InfTime || ts[2] != NegInfTime {
+		t.Error("Wrong timestamp sentinels", ts)
+	}
+	// times beyond q range are encoded as infinities
+	far := time.Date(9999999, 1, 1, 0, 0, 0, 0, time.UTC)
+	if d := atomValue(-KD, far); d != Wi {
+		t.Error("Expected date infinity, got", d)
+	}
+	if d := atomValue(-KP, time.Date(1000, 1, 1, 0, 0, 0, 0, time.UTC)); d != time.Duration(-Wj) {
+		t.Error("Expected negative timestamp infinity, got", d)
+	}
+	if f := atomValue(-KZ, InfTime); !math.IsInf(f.(float64), 1) {
+		t.Error("Expected datetime infinity, got", f)
+	}
+}
+
+type nullableRow struct {
+	Sym   *string
+	Size  *int64
+	Price sql.NullFloat64
+	Date  Nullable[time.Time]
+	Time  Nullable[Time]
+	Note  sql.NullString
+	Count Nullable[int]
+}
+
+func TestUnmarshalNulls(t *testing.T) {
+	tbl := NewTable([]string{"sym", "size", "price", "date", "time", "note", "count"}, []*K{
+		SymbolV([]string{"a", ""}),
+		LongV([]int64{1, Nj}),
+		FloatV([]float64{1.5, Nf}),
+		DateV([]Date{NewDate(DateAsTime), Date(NullTime)}),
+		{KT, NONE, []Time{NewTime(time.Hour), Time(NullTime)}},
+		{KC, NONE, "x "},
+		IntV([]int32{2, Ni}),
+	}).Data.(Table)
+	res, err := UnmarshalTable(tbl, &[]nullableRow{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows := res.([]nullableRow)
+	r := rows[0]
+	if *r.Sym != "a" || *r.Size != 1 || r.Price != (sql.NullFloat64{Float64: 1.5, Valid: true}) ||
+		r.Date != (Nullable[time.Time]{DateAsTime, true}) || r.Time != (Nullable[Time]{NewTime(time.Hour), true}) ||
+		r.Note != (sql.NullString{String: "x", Valid: true}) || r.Count != (Nullable[int]{2, true}) {
+		t.Errorf("Wrong first row %+v", r)
+	}
+	if r := rows[1]; r != (nullableRow{}) {
+		t.Errorf("Expected nulls in second row, got %+v", r)
+	}
+
+	reg := NewRegistry()
+	reg.Register("size", func(size *int64, price Nullable[float64]) bool { return size == nil && !price.Valid })
+	res2, err := reg.ServeKDB(context.Background(), nil, SYNC, NewList(Symbol("size"), Long(Nj), Float(Nf)))
+	if err != nil || res2.Data != true {
+		t.Error("Expected nulls as nil pointer and invalid Nullable, got", res2, err)
+	}
+	if _, err = reg.ServeKDB(context.Background(), nil, SYNC, NewList(Symbol("size"), Long(1), Symbol("a"))); err == nil {
+		t.Error("Expected conversion error for symbol")
+	}
+}
@@ -0,0 +1,297 @@
+package kdb
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrPoolClosed is returned by Pool.Get after the pool has been closed
+var ErrPoolClosed = errors.New("Pool is closed")
+
+// defaultMaxIdle is number of idle connections kept when Pool.MaxIdle is not set
+const defaultMaxIdle = 2
+
+// PoolStats contains pool statistics similar to database/sql DBStats
+type PoolStats struct {
+	MaxOpenConnections int // Maximum number of open connections
+
+	OpenConnections int // Number of established connections both in use and idle
+	InUse           int // Number of connections currently in use
+	Idle            int // Number of idle connections
+
+	WaitCount         int64         // Total number of connections waited for
+	WaitDuration      time.Duration // Total time blocked waiting for a new connection
+	MaxIdleClosed     int64         // Total number of connections closed due to MaxIdle
+	MaxIdleTimeClosed int64         // Total number of connections closed due to IdleTimeout
+	HealthCheckFailed int64         // Total number of connections closed due to failed health check
+	BrokenClosed      int64         // Total number of connections closed due to I/O errors
+}
+
+// Pool maintains a set of connections to the same kdb+ process.
+// Connections are handed out by Get and must be returned with Put.
+// Configuration fields must not be changed after the first call to Get.
+type Pool struct {
+	// Dial opens new connection
+	Dial func(ctx context.Context) (*KDBConn, error)
+	// HealthCheck is called before idle connection is reused.
+	// Connection is discarded if it returns an error. Defaults to KDBConn.Ping.
+	HealthCheck func(ctx context.Context, c *KDBConn) error
+	// MaxOpen limits number of open connections. Zero means no limit.
+	MaxOpen int
+	// MaxIdle limits number of idle connections. Zero means default of 2, negative - no idle connections.
+	MaxIdle int
+	// IdleTimeout closes connections which were idle for longer. Zero means connections are kept forever.
+	IdleTimeout time.Duration
+
+	mu      sync.Mutex
+	idle    []idleConn
+	numOpen int
+	waiters []chan *KDBConn
+	closed  bool
+	reaping bool
+	stats   PoolStats
+}
+
+type idleConn struct {
+	c     *KDBConn
+	since time.Time
+}
+
+// NewPool creates pool which opens connections using dial
+func NewPool(dial func(ctx context.Context) (*KDBConn, error)) *Pool {
+	return &Pool{Dial: dial}
+}
+
+func (p *Pool) maxIdle() int {
+	switch {
+	case p.MaxIdle == 0:
+		return defaultMaxIdle
+	case p.MaxIdle < 0:
+		return 0
+	}
+	return p.MaxIdle
+}
+
+func (p *Pool) healthCheck(ctx context.Context, c *KDBConn) error {
+	if p.HealthCheck != nil {
+		return p.HealthCheck(ctx, c)
+	}
+	return c.Ping(ctx)
+}
+
+// Get returns idle connection which passed health check or opens a new one.
+// If MaxOpen connections are in use Get blocks until one is returned or ctx is done.
+func (p *Pool) Get(ctx context.Context) (*KDBConn, error) {
+	for {
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			return nil, ErrPoolClosed
+		}
+		if n := len(p.idle); n > 0 {
+			ic := p.idle[n-1]
+			p.idle = p.idle[:n-1]
+			if p.expired(ic) {
+				p.stats.MaxIdleTimeClosed++
+				p.release(ic.c)
+				p.mu.Unlock()
+				continue
+			}
+			p.mu.Unlock()
+			if err := p.healthCheck(ctx, ic.c); err != nil {
+				if ctx.Err() != nil {
+					p.Put(ic.c)
+					return nil, ctx.Err()
+				}
+				p.mu.Lock()
+				p.stats.HealthCheckFailed++
+				p.release(ic.c)
+				p.mu.Unlock()
+				continue
+			}
+			return ic.c, nil
+		}
+		if p.MaxOpen <= 0 || p.numOpen < p.MaxOpen {
+			p.numOpen++
+			p.mu.Unlock()
+			c, err := p.Dial(ctx)
+			if err != nil {
+				p.mu.Lock()
+				p.numOpen--
+				p.wakeup()
+				p.mu.Unlock()
+				return nil, err
+			}
+			return c, nil
+		}
+		// wait for connection to be returned or for a free slot
+		ch := make(chan *KDBConn, 1)
+		p.waiters = append(p.waiters, ch)
+		p.stats.WaitCount++
+		start := time.Now()
+		p.mu.Unlock()
+		select {
+		case c := <-ch:
+			p.mu.Lock()
+			p.stats.WaitDuration += time.Since(start)
+			p.mu.Unlock()
+			if c != nil {
+				return c, nil
+			}
+		case <-ctx.Done():
+			p.mu.Lock()
+			p.stats.WaitDuration += time.Since(start)
+			for i, w := range p.waiters {
+				if w == ch {
+					p.waiters = append(p.waiters[:i], p.waiters[i+1:]...)
+					break
+				}
+			}
+			p.mu.Unlock()
+			// connection or free slot might have been handed over in the meantime
+			select {
+			case c := <-ch:
+				if c != nil {
+					p.Put(c)
+				} else {
+					p.mu.Lock()
+					p.wakeup()
+					p.mu.Unlock()
+				}
+			default:
+			}
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Put returns connection obtained from Get to the pool.
+// Connections which encountered an I/O error are closed.
+func (p *Pool) Put(c *KDBConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if c.broken() != nil {
+		p.stats.BrokenClosed++
+		p.release(c)
+		return
+	}
+	if p.closed {
+		p.release(c)
+		return
+	}
+	if len(p.waiters) > 0 {
+		ch := p.waiters[0]
+		p.waiters = p.waiters[1:]
+		ch <- c
+		return
+	}
+	if len(p.idle) >= p.maxIdle() {
+		p.stats.MaxIdleClosed++
+		p.release(c)
+		return
+	}
+	p.idle = append(p.idle, idleConn{c, time.Now()})
+	if p.IdleTimeout > 0 && !p.reaping {
+		p.reaping = true
+		go p.reaper()
+	}
+}
+
+// Call gets connection from the pool, performs synchronous call and returns connection back
+func (p *Pool) Call(ctx context.Context, cmd string, args ...*K) (*K, error) {
+	c, err := p.Get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer p.Put(c)
+	return c.CallContext(ctx, cmd, args...)
+}
+
+// Stats returns pool statistics
+func (p *Pool) Stats() PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	stats := p.stats
+	stats.MaxOpenConnections = p.MaxOpen
+	stats.OpenConnections = p.numOpen
+	stats.Idle = len(p.idle)
+	stats.InUse = p.numOpen - len(p.idle)
+	return stats
+}
+
+// Close closes idle connections and prevents new ones from being handed out.
+// Connections in use are closed when returned.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return ErrPoolClosed
+	}
+	p.closed = true
+	for _, ic := range p.idle {
+		p.release(ic.c)
+	}
+	p.idle = nil
+	for _, ch := range p.waiters {
+		close(ch)
+	}
+	p.waiters = nil
+	return nil
+}
+
+func (p *Pool) expired(ic idleConn) bool {
+	return p.IdleTimeout > 0 && time.Since(ic.since) > p.IdleTimeout
+}
+
+// release closes connection and wakes up a waiter. p.mu must be held.
+func (p *Pool) release(c *KDBConn) {
+	p.numOpen--
+	c.Close()
+	p.wakeup()
+}
+
+// wakeup notifies first waiter that a connection slot is free. p.mu must be held.
+func (p *Pool) wakeup() {
+	if len(p.waiters) == 0 {
+		return
+	}
+	ch := p.waiters[0]
+	p.waiters = p.waiters[1:]
+	ch <- nil
+}
+
+// reaper periodically closes connections idle for longer than IdleTimeout
+func (p *Pool) reaper() {
+	interval := p.IdleTimeout / 2
+	if interval < time.Second {
+		interval = time.Second
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for range t.C {
+		p.mu.Lock()
+		if p.closed {
+			p.reaping = false
+			p.mu.Unlock()
+			return
+		}
+		kept := p.idle[:0]
+		for _, ic := range p.idle {
+			if p.expired(ic) {
+				p.stats.MaxIdleTimeClosed++
+				p.release(ic.c)
+			} else {
+				kept = append(kept, ic)
+			}
+		}
+		p.idle = kept
+		if len(p.idle) == 0 {
+			p.reaping = false
+			p.mu.Unlock()
+			return
+		}
+		p.mu.Unlock()
+	}
+}
@@ -0,0 +1,156 @@
+package kdb
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func newTestPool(t *testing.T, serve func(net.Conn)) *Pool {
+	port := mockServer(t, serve)
+	return NewPool(func(ctx context.Context) (*KDBConn, error) {
+		return DialKDB("localhost", port, "")
+	})
+}
+
+func TestPoolReuse(t *testing.T) {
+	p := newTestPool(t, echoServer)
+	defer p.Close()
+	ctx := context.Background()
+	c1, err := p.Get(ctx)
+	if err != nil {
+		t.Fatal("Failed to get connection", err)
+	}
+	p.Put(c1)
+	c2, err := p.Get(ctx)
+	if err != nil {
+		t.Fatal("Failed to get connection", err)
+	}
+	if c1 != c2 {
+		t.Error("Idle connection was not reused")
+	}
+	stats := p.Stats()
+	if stats.OpenConnections != 1 || stats.InUse != 1 || stats.Idle != 0 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+	p.Put(c2)
+	if stats = p.Stats(); stats.InUse != 0 || stats.Idle != 1 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+}
+
+func TestPoolMaxOpen(t *testing.T) {
+	p := newTestPool(t, echoServer)
+	p.MaxOpen = 1
+	defer p.Close()
+	ctx := context.Background()
+	c1, err := p.Get(ctx)
+	if err != nil {
+		t.Fatal("Failed to get connection", err)
+	}
+	got := make(chan *KDBConn)
+	go func() {
+		c, err := p.Get(ctx)
+		if err != nil {
+			t.Error("Failed to get connection", err)
+		}
+		got <- c
+	}()
+	time.Sleep(50 * time.Millisecond)
+	p.Put(c1)
+	if c2 := <-got; c2 != c1 {
+		t.Error("Waiter did not receive returned connection")
+	}
+	stats := p.Stats()
+	if stats.WaitCount != 1 || stats.WaitDuration <= 0 || stats.OpenConnections != 1 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+
+	tctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, err = p.Get(tctx); err != context.DeadlineExceeded {
+		t.Error("Expected deadline error, got", err)
+	}
+}
+
+func TestPoolDiscardBroken(t *testing.T) {
+	p := newTestPool(t, silentServer)
+	defer p.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := p.Call(ctx, "hang"); err != context.DeadlineExceeded {
+		t.Fatal("Expected deadline error, got", err)
+	}
+	stats := p.Stats()
+	if stats.OpenConnections != 0 || stats.BrokenClosed != 1 {
+		t.Errorf("Broken connection was not discarded: %+v", stats)
+	}
+}
+
+func TestPoolQError(t *testing.T) {
+	p := newTestPool(t, respondingServer(func(req *K) *K { return Error(errors.New("type")) }))
+	defer p.Close()
+	_, err := p.Call(context.Background(), "1+`a")
+	if _, ok := err.(QError); !ok {
+		t.Fatalf("Expected q error, got %#v", err)
+	}
+	if stats := p.Stats(); stats.Idle != 1 {
+		t.Errorf("Connection should be kept after q error: %+v", stats)
+	}
+}
+
+func TestPoolHealthCheck(t *testing.T) {
+	p := newTestPool(t, echoServer)
+	defer p.Close()
+	p.HealthCheck = func(ctx context.Context, c *KDBConn) error {
+		return errors.New("unhealthy")
+	}
+	ctx := context.Background()
+	c1, _ := p.Get(ctx)
+	p.Put(c1)
+	c2, err := p.Get(ctx)
+	if err != nil {
+		t.Fatal("Failed to get connection", err)
+	}
+	if c1 == c2 {
+		t.Error("Unhealthy connection was reused")
+	}
+	if stats := p.Stats(); stats.HealthCheckFailed != 1 || stats.OpenConnections != 1 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+}
+
+func TestPoolIdleTimeout(t *testing.T) {
+	p := newTestPool(t, echoServer)
+	p.IdleTimeout = 10 * time.Millisecond
+	defer p.Close()
+	ctx := context.Background()
+	c1, _ := p.Get(ctx)
+	p.Put(c1)
+	time.Sleep(20 * time.Millisecond)
+	c2, err := p.Get(ctx)
+	if err != nil {
+		t.Fatal("Failed to get connection", err)
+	}
+	if c1 == c2 {
+		t.Error("Expired connection was reused")
+	}
+	if stats := p.Stats(); stats.MaxIdleTimeClosed != 1 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+}
+
+func TestPoolClose(t *testing.T) {
+	p := newTestPool(t, echoServer)
+	c, _ := p.Get(context.Background())
+	p.Close()
+	if _, err := p.Get(context.Background()); err != ErrPoolClosed {
+		t.Error("Expected closed pool error, got", err)
+	}
+	p.Put(c)
+	if stats := p.Stats(); stats.OpenConnections != 0 {
+		t.Errorf("Connection was not closed: %+v", stats)
+	}
+}
@@ -0,0 +1,280 @@
+package kdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Backoff computes jittered exponential delays between reconnection attempts
+type Backoff struct {
+	Initial    time.Duration // delay before the first attempt
+	Max        time.Duration // upper bound for delay
+	Multiplier float64       // growth factor applied after every failed attempt
+	Jitter     float64       // fraction of delay randomised in both directions, 0..1
+}
+
+// DefaultBackoff is used by ReconnectingConn unless configured otherwise
+var DefaultBackoff = Backoff{
+	Initial:    100 * time.Millisecond,
+	Max:        30 * time.Second,
+	Multiplier: 2,
+	Jitter:     0.2,
+}
+
+// Delay returns time to wait before attempt, counting from 0
+func (b Backoff) Delay(attempt int) time.Duration {
+	d := float64(b.Initial) * math.Pow(b.Multiplier, float64(attempt))
+	if b.Max > 0 && d > float64(b.Max) {
+		d = float64(b.Max)
+	}
+	if b.Jitter > 0 {
+		d += (rand.Float64()*2 - 1) * b.Jitter * d
+	}
+	if b.Max > 0 && d > float64(b.Max) {
+		d = float64(b.Max)
+	}
+	return time.Duration(d)
+}
+
+// ReconnectError is returned by ReconnectingConn once it gave up reconnecting
+type ReconnectError struct {
+	Attempts int   // number of failed attempts
+	Err      error // last error
+}
+
+func (e *ReconnectError) Error() string {
+	return fmt.Sprintf("Gave up reconnecting after %d attempts: %v", e.Attempts, e.Err)
+}
+
+// Unwrap returns the last reconnection error
+func (e *ReconnectError) Unwrap() error {
+	return e.Err
+}
+
+// ReconnectingConn wraps KDBConn and re-dials with the original parameters
+// whenever connection fails with an I/O error.
+// Configuration fields must be set before the connection is used.
+type ReconnectingConn struct {
+	// Backoff controls delay between reconnection attempts
+	Backoff Backoff
+	// MaxAttempts limits number of consecutive failed attempts. Zero means no limit.
+	MaxAttempts int
+	// MaxElapsed limits time spent reconnecting. Zero means no limit.
+	MaxElapsed time.Duration
+	// OnDisconnect is called once with the error which broke the connection
+	OnDisconnect func(err error)
+	// OnReconnect is called with the new connection before it is used,
+	// e.g. to re-issue subscriptions. Returned error fails reconnection attempt.
+	OnReconnect func(c *KDBConn) error
+
+	mu     sync.Mutex // guards conn and err
+	conn   *KDBConn
+	err    error      // terminal error
+	rmu    sync.Mutex // serialises reconnections
+	down   *KDBConn   // broken connection already reported to OnDisconnect, guarded by rmu
+	closed chan struct{}
+	once   sync.Once
+}
+
+// NewReconnectingConn wraps connection created by one of Dial functions
+func NewReconnectingConn(c *KDBConn) (*ReconnectingConn, error) {
+	if c.redial == nil {
+		return nil, errors.New("Connection cannot be re-dialled")
+	}
+	return &ReconnectingConn{
+		Backoff: DefaultBackoff,
+		conn:    c,
+		closed:  make(chan struct{}),
+	}, nil
+}
+
+// Conn returns current underlying connection
+func (r *ReconnectingConn) Conn() (*KDBConn, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.conn, r.err
+}
+
+// current returns connection to use. Connection which broke during an earlier call
+// is re-dialled first, as that call may have given up reconnecting when its ctx expired.
+func (r *ReconnectingConn) current(ctx context.Context) (*KDBConn, error) {
+	c, err := r.Conn()
+	if err != nil {
+		return nil, err
+	}
+	if cause := c.broken(); cause != nil {
+		if err = r.reconnect(ctx, c, cause); err != nil {
+			return nil, err
+		}
+		return r.Conn()
+	}
+	return c, nil
+}
+
+// Call performs synchronous call. If connection fails it is re-established
+// before returning the error, so the call can be retried.
+func (r *ReconnectingConn) Call(cmd string, args ...*K) (*K, error) {
+	return r.CallContext(context.Background(), cmd, args...)
+}
+
+// CallContext performs synchronous call bounded by ctx. See Call.
+func (r *ReconnectingConn) CallContext(ctx context.Context, cmd string, args ...*K) (*K, error) {
+	c, err := r.current(ctx)
+	if err != nil {
+		return nil, err
+	}
+	data, err := c.CallContext(ctx, cmd, args...)
+	if err != nil {
+		return nil, r.recover(ctx, c, err)
+	}
+	return data, nil
+}
+
+// AsyncCall performs asynchronous call. If connection fails it is re-established
+// before returning the error, so the call can be retried.
+func (r *ReconnectingConn) AsyncCall(cmd string, args ...*K) error {
+	return r.AsyncCallContext(context.Background(), cmd, args...)
+}
+
+// AsyncCallContext performs asynchronous call bounded by ctx. See AsyncCall.
+func (r *ReconnectingConn) AsyncCallContext(ctx context.Context, cmd string, args ...*K) error {
+	c, err := r.current(ctx)
+	if err != nil {
+		return err
+	}
+	if err = c.AsyncCallContext(ctx, cmd, args...); err != nil {
+		return r.recover(ctx, c, err)
+	}
+	return nil
+}
+
+// WriteMessage sends data in Q IPC format. See AsyncCall for failure handling.
+func (r *ReconnectingConn) WriteMessage(msgtype ReqType, data *K) error {
+	c, err := r.current(context.Background())
+	if err != nil {
+		return err
+	}
+	if err = c.WriteMessage(msgtype, data); err != nil {
+		return r.recover(context.Background(), c, err)
+	}
+	return nil
+}
+
+// ReadMessage reads complete message from connection. If connection fails
+// it is re-established and reading continues on the new connection.
+// Error is returned only when reconnection gave up or connection was closed.
+func (r *ReconnectingConn) ReadMessage() (*K, ReqType, error) {
+	for {
+		c, err := r.Conn()
+		if err != nil {
+			return nil, -1, err
+		}
+		data, msgtype, err := c.ReadMessage()
+		if err == nil {
+			return data, msgtype, nil
+		}
+		if c.broken() == nil {
+			return nil, msgtype, err
+		}
+		if err = r.reconnect(context.Background(), c, err); err != nil {
+			return nil, -1, err
+		}
+	}
+}
+
+// Close closes connection and stops reconnecting
+func (r *ReconnectingConn) Close() error {
+	r.once.Do(func() { close(r.closed) })
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err == nil {
+		r.err = errors.New("Closed connection")
+	}
+	return r.conn.Close()
+}
+
+// recover reconnects if c is broken and returns the original error
+// unless reconnection gave up. If ctx is done before reconnection completes,
+// the connection is re-dialled on next use.
+func (r *ReconnectingConn) recover(ctx context.Context, c *KDBConn, cause error) error {
+	if c.broken() == nil {
+		return cause
+	}
+	if err := r.reconnect(ctx, c, cause); err != nil && err != ctx.Err() {
+		return err
+	}
+	return cause
+}
+
+// reconnect replaces failed connection with a new one
+func (r *ReconnectingConn) reconnect(ctx context.Context, failed *KDBConn, cause error) error {
+	r.rmu.Lock()
+	defer r.rmu.Unlock()
+	c, err := r.Conn()
+	if err != nil {
+		return err
+	}
+	if c != failed {
+		// already reconnected by another caller
+		return nil
+	}
+	if r.down != failed {
+		r.down = failed
+		failed.Close()
+		if r.OnDisconnect != nil {
+			r.OnDisconnect(cause)
+		}
+	}
+	start := time.Now()
+	for attempt := 0; ; attempt++ {
+		if r.MaxAttempts > 0 && attempt >= r.MaxAttempts ||
+			r.MaxElapsed > 0 && time.Since(start) >= r.MaxElapsed {
+			return r.giveUp(&ReconnectError{attempt, cause})
+		}
+		t := time.NewTimer(r.Backoff.Delay(attempt))
+		select {
+		case <-t.C:
+		case <-r.closed:
+			t.Stop()
+			return errors.New("Closed connection")
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		}
+		var nc *KDBConn
+		nc, cause = failed.redial(ctx)
+		if cause != nil {
+			continue
+		}
+		if r.OnReconnect != nil {
+			if cause = r.OnReconnect(nc); cause != nil {
+				nc.Close()
+				continue
+			}
+		}
+		r.mu.Lock()
+		if r.err != nil {
+			// closed while reconnecting
+			r.mu.Unlock()
+			nc.Close()
+			return r.err
+		}
+		r.conn = nc
+		r.mu.Unlock()
+		return nil
+	}
+}
+
+func (r *ReconnectingConn) giveUp(err error) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err == nil {
+		r.err = err
+	}
+	return r.err
+}
@@ -0,0 +1,141 @@
+package kdb
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var testBackoff = Backoff{Initial: time.Millisecond, Max: 10 * time.Millisecond, Multiplier: 2, Jitter: 0.5}
+
+func TestBackoffDelay(t *testing.T) {
+	b := Backoff{Initial: 100 * time.Millisecond, Max: time.Second, Multiplier: 2}
+	expected := []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second, time.Second}
+	for i, d := range expected {
+		if got := b.Delay(i); got != d {
+			t.Errorf("Delay(%d) expected %s, got %s", i, d, got)
+		}
+	}
+	b.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if d := b.Delay(1); d < 100*time.Millisecond || d > 300*time.Millisecond {
+			t.Fatal("Jittered delay out of range:", d)
+		}
+	}
+}
+
+func TestReconnectReadMessage(t *testing.T) {
+	var conns int32
+	port := mockServer(t, func(conn net.Conn) {
+		defer conn.Close()
+		if atomic.AddInt32(&conns, 1) == 1 {
+			// first connection dies straight away
+			return
+		}
+		// publish once subscribed
+		rbuf := bufio.NewReader(conn)
+		if _, _, err := Decode(rbuf); err != nil {
+			return
+		}
+		Encode(conn, ASYNC, NewList(Symbol("upd"), Symbol("trade")))
+		Decode(rbuf)
+	})
+	c, err := DialKDB("localhost", port, "")
+	if err != nil {
+		t.Fatalf("Failed to connect to mock server: %s", err)
+	}
+	r, err := NewReconnectingConn(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	r.Backoff = testBackoff
+	var disconnected, reconnected int
+	r.OnDisconnect = func(err error) { disconnected++ }
+	r.OnReconnect = func(c *KDBConn) error {
+		reconnected++
+		return c.AsyncCall(".u.sub", Symbol("trade"), Symbol(""))
+	}
+	data, msgtype, err := r.ReadMessage()
+	if err != nil {
+		t.Fatal("ReadMessage failed", err)
+	}
+	if msgtype != ASYNC || data.Len() != 2 {
+		t.Error("Unexpected message:", data, msgtype)
+	}
+	if disconnected != 1 || reconnected != 1 {
+		t.Errorf("Expected single disconnect/reconnect, got %d/%d", disconnected, reconnected)
+	}
+	if nc, _ := r.Conn(); nc == c {
+		t.Error("Connection was not replaced")
+	}
+}
+
+func TestReconnectGiveUp(t *testing.T) {
+	port := mockServer(t, func(conn net.Conn) { conn.Close() })
+	c, err := DialKDB("localhost", port, "")
+	if err != nil {
+		t.Fatalf("Failed to connect to mock server: %s", err)
+	}
+	r, _ := NewReconnectingConn(c)
+	defer r.Close()
+	r.Backoff = testBackoff
+	r.MaxAttempts = 3
+	var reconnects int
+	rejected := errors.New("rejected")
+	r.OnReconnect = func(c *KDBConn) error {
+		reconnects++
+		return rejected
+	}
+	_, err = r.Call("1+1")
+	rerr, ok := err.(*ReconnectError)
+	if !ok {
+		t.Fatalf("Expected reconnect error, got %#v", err)
+	}
+	if rerr.Attempts != 3 || rerr.Err != rejected || reconnects != 3 {
+		t.Errorf("Unexpected give up: %s after %d reconnects", rerr, reconnects)
+	}
+	if _, _, err = r.ReadMessage(); err != rerr {
+		t.Error("Terminal error expected, got", err)
+	}
+}
+
+func TestReconnectAfterTimeout(t *testing.T) {
+	var conns int32
+	port := mockServer(t, func(conn net.Conn) {
+		if atomic.AddInt32(&conns, 1) == 1 {
+			// first connection never responds
+			silentServer(conn)
+			return
+		}
+		echoServer(conn)
+	})
+	c, err := DialKDB("localhost", port, "")
+	if err != nil {
+		t.Fatalf("Failed to connect to mock server: %s", err)
+	}
+	r, _ := NewReconnectingConn(c)
+	defer r.Close()
+	r.Backoff = testBackoff
+	var disconnected int32
+	r.OnDisconnect = func(err error) { atomic.AddInt32(&disconnected, 1) }
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err = r.CallContext(ctx, "1+1"); err != context.DeadlineExceeded {
+		t.Fatal("Expected deadline exceeded, got", err)
+	}
+	res, err := r.Call("1+1")
+	if err != nil {
+		t.Fatal("Call after timeout failed:", err)
+	}
+	if res.Data != "1+1" {
+		t.Error("Unexpected response", res)
+	}
+	if n := atomic.LoadInt32(&disconnected); n != 1 {
+		t.Error("Expected single disconnect, got", n)
+	}
+}
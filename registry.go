@@ -0,0 +1,349 @@
+package kdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/nu7hatch/gouuid"
+)
+
+// Registry is a Handler invoking Go functions registered by name.
+// q calls them with a list whose first element is function name as symbol or string, e.g.
+//
+//	h(`fetchQuote;`AAPL;2024.01.02)
+//	h("fetchQuote";`AAPL;2024.01.02)
+//
+// Arguments are converted to parameter types of the function and results are converted back to K.
+// Returned error is sent to q as an error.
+type Registry struct {
+	mu    sync.RWMutex
+	funcs map[string]reflect.Value
+}
+
+var (
+	contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+	kType       = reflect.TypeOf((*K)(nil))
+	timeType    = reflect.TypeOf(time.Time{})
+)
+
+// NewRegistry creates empty function registry
+func NewRegistry() *Registry {
+	return &Registry{funcs: make(map[string]reflect.Value)}
+}
+
+// Register makes fn callable from q as name.
+// fn may take context.Context as the first parameter and may return a value, an error or both.
+// Parameters can be *K to receive arguments unconverted.
+func (r *Registry) Register(name string, fn interface{}) error {
+	v := reflect.ValueOf(fn)
+	if v.Kind() != reflect.Func {
+		return errors.New("Only functions can be registered, got " + v.Kind().String())
+	}
+	t := v.Type()
+	switch {
+	case t.NumOut() > 2,
+		t.NumOut() == 2 && t.Out(1) != errorType:
+		return errors.New("Function " + name + " should return value, error or both")
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.funcs == nil {
+		r.funcs = make(map[string]reflect.Value)
+	}
+	r.funcs[name] = v
+	return nil
+}
+
+// ServeKDB calls registered function named by the first element of data
+func (r *Registry) ServeKDB(ctx context.Context, c *ServerConn, msgtype ReqType, data *K) (*K, error) {
+	name, args, err := parseCall(data)
+	if err != nil {
+		return nil, err
+	}
+	r.mu.RLock()
+	fn, ok := r.funcs[name]
+	r.mu.RUnlock()
+	if !ok {
+		return nil, errors.New("Unknown function " + name)
+	}
+	return callFunc(ctx, name, fn, args)
+}
+
+// parseCall splits (`name;args...) into function name and arguments.
+// Function without arguments can be called with the name alone.
+func parseCall(data *K) (string, []*K, error) {
+	switch data.Type {
+	case -KS, KC:
+		return data.Data.(string), nil, nil
+	case K0:
+		list := data.Data.([]*K)
+		if len(list) > 0 && (list[0].Type == -KS || list[0].Type == KC) {
+			return list[0].Data.(string), list[1:], nil
+		}
+	}
+	return "", nil, errors.New("Expected function call as (`name;args...)")
+}
+
+func callFunc(ctx context.Context, name string, fn reflect.Value, args []*K) (*K, error) {
+	t := fn.Type()
+	var in []reflect.Value
+	if t.NumIn() > 0 && t.In(0) == contextType {
+		in = append(in, reflect.ValueOf(ctx))
+	}
+	// q sends (`f;::) for niladic call f[]
+	if len(args) == 1 && args[0].Type == KFUNCUP && len(in) == t.NumIn() {
+		args = nil
+	}
+	if t.IsVariadic() || len(in)+len(args) != t.NumIn() {
+		return nil, fmt.Errorf("%s expects %d arguments, got %d", name, t.NumIn()-len(in), len(args))
+	}
+	for i, arg := range args {
+		v, err := fromK(arg, t.In(len(in)))
+		if err != nil {
+			return nil, fmt.Errorf("%s: argument %d: %v", name, i+1, err)
+		}
+		in = append(in, v)
+	}
+	out := fn.Call(in)
+	if n := len(out); n > 0 && t.Out(n-1) == errorType {
+		if err, _ := out[n-1].Interface().(error); err != nil {
+			return nil, err
+		}
+		out = out[:n-1]
+	}
+	if len(out) == 0 {
+		return nil, nil
+	}
+	return toK(out[0])
+}
+
+// fromK converts K object to value of type t
+func fromK(k *K, t reflect.Type) (reflect.Value, error) {
+	if t == kType {
+		return reflect.ValueOf(k), nil
+	}
+	if k.Data == nil {
+		return reflect.Zero(t), nil
+	}
+	if isNullable(t) {
+		v := reflect.New(t).Elem()
+		return v, setNullable(v, k)
+	}
+	dv := reflect.ValueOf(k.Data)
+	if dv.Type().AssignableTo(t) {
+		v := reflect.New(t).Elem()
+		v.Set(dv)
+		return v, nil
+	}
+	switch {
+	case isNumeric(dv.Kind()) && isNumeric(t.Kind()), sameKind(dv.Type(), t):
+		return dv.Convert(t), nil
+	case t.Kind() == reflect.Slice && k.Type == K0:
+		list := k.Data.([]*K)
+		v := reflect.MakeSlice(t, len(list), len(list))
+		for i, e := range list {
+			ev, err := fromK(e, t.Elem())
+			if err != nil {
+				return v, err
+			}
+			v.Index(i).Set(ev)
+		}
+		return v, nil
+	case t.Kind() == reflect.Slice && dv.Kind() == reflect.Slice && (isNumeric(dv.Type().Elem().Kind()) && isNumeric(t.Elem().Kind()) ||
+		sameKind(dv.Type().Elem(), t.Elem())):
+		v := reflect.MakeSlice(t, dv.Len(), dv.Len())
+		for i := 0; i < dv.Len(); i++ {
+			v.Index(i).Set(dv.Index(i).Convert(t.Elem()))
+		}
+		return v, nil
+	case t.Kind() == reflect.String && k.Type == -KC:
+		return reflect.ValueOf(string(k.Data.(byte))).Convert(t), nil
+	case t.Kind() == reflect.String && dv.Kind() == reflect.String:
+		return dv.Convert(t), nil
+	case t.Kind() == reflect.Struct && k.Type == XD:
+		v := reflect.New(t)
+		err := UnmarshalDict(k.Data.(Dict), v.Interface())
+		return v.Elem(), err
+	case t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Struct && k.Type == XT:
+		v := reflect.New(t)
+		res, err := UnmarshalTable(k.Data.(Table), v.Interface())
+		if err != nil {
+			return v.Elem(), err
+		}
+		return reflect.ValueOf(res), nil
+	}
+	return reflect.Value{}, fmt.Errorf("cannot convert %v to %v", dv.Type(), t)
+}
+
+func isNumeric(kind reflect.Kind) bool {
+	return kind >= reflect.Int && kind <= reflect.Float64
+}
+
+// sameKind reports whether from converts to type of the same kind, e.g. Date to time.Time or Timespan to time.Duration
+func sameKind(from, to reflect.Type) bool {
+	return from.Kind() == to.Kind() && from.ConvertibleTo(to)
+}
+
+// atomTypes maps Go types to q atom types, vectors use negated value
+var atomTypes = map[reflect.Type]int8{
+	reflect.TypeOf(false):            -KB,
+	reflect.TypeOf(uuid.UUID{}):      -UU,
+	reflect.TypeOf(byte(0)):          -KG,
+	reflect.TypeOf(int16(0)):         -KH,
+	reflect.TypeOf(int32(0)):         -KI,
+	reflect.TypeOf(int64(0)):         -KJ,
+	reflect.TypeOf(float32(0)):       -KE,
+	reflect.TypeOf(float64(0)):       -KF,
+	reflect.TypeOf(""):               -KS,
+	timeType:                         -KP,
+	reflect.TypeOf(Month(0)):         -KM,
+	reflect.TypeOf(time.Duration(0)): -KN,
+	reflect.TypeOf(Date{}):           -KD,
+	reflect.TypeOf(Timespan(0)):      -KN,
+	reflect.TypeOf(Minute{}):         -KU,
+	reflect.TypeOf(Second{}):         -KV,
+	reflect.TypeOf(Time{}):           -KT,
+}
+
+// toK converts Go value to K object.
+// Strings become symbols, structs become dictionaries and slices of structs become tables.
+func toK(v reflect.Value) (*K, error) {
+	if !v.IsValid() {
+		return nil, nil
+	}
+	if v.Type() == kType {
+		return v.Interface().(*K), nil
+	}
+	if qt, ok := atomTypes[v.Type()]; ok {
+		return &K{qt, NONE, v.Interface()}, nil
+	}
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return nil, nil
+		}
+		return toK(v.Elem())
+	case reflect.Bool:
+		return &K{-KB, NONE, v.Bool()}, nil
+	case reflect.Int16:
+		return &K{-KH, NONE, int16(v.Int())}, nil
+	case reflect.Int32:
+		return Int(int32(v.Int())), nil
+	case reflect.Int, reflect.Int8, reflect.Int64:
+		return Long(v.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return Long(int64(v.Uint())), nil
+	case reflect.Float32:
+		return Real(float32(v.Float())), nil
+	case reflect.Float64:
+		return Float(v.Float()), nil
+	case reflect.String:
+		return Symbol(v.String()), nil
+	case reflect.Slice, reflect.Array:
+		return sliceToK(v)
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return nil, fmt.Errorf("cannot convert %v to K", v.Type())
+		}
+		keys := make([]string, 0, v.Len())
+		for _, kv := range v.MapKeys() {
+			keys = append(keys, kv.String())
+		}
+		sort.Strings(keys)
+		vals := make([]*K, len(keys))
+		for i, key := range keys {
+			kv, err := toK(v.MapIndex(reflect.ValueOf(key).Convert(v.Type().Key())))
+			if err != nil {
+				return nil, err
+			}
+			vals[i] = orIdentity(kv)
+		}
+		return NewDict(SymbolV(keys), NewList(vals...)), nil
+	case reflect.Struct:
+		cols := structFields(v.Type())
+		vals := make([]*K, len(cols))
+		for i, f := range cols {
+			fv, err := toK(v.FieldByIndex(f.Index))
+			if err != nil {
+				return nil, err
+			}
+			vals[i] = orIdentity(fv)
+		}
+		return NewDict(SymbolV(columnNames(cols)), NewList(vals...)), nil
+	}
+	return nil, fmt.Errorf("cannot convert %v to K", v.Type())
+}
+
+// sliceToK converts slice to vector, table for slice of structs or generic list otherwise
+func sliceToK(v reflect.Value) (*K, error) {
+	et := v.Type().Elem()
+	if qt, ok := atomTypes[et]; ok {
+		if v.Kind() == reflect.Array {
+			s := reflect.MakeSlice(reflect.SliceOf(et), v.Len(), v.Len())
+			reflect.Copy(s, v)
+			v = s
+		}
+		return &K{-qt, NONE, v.Interface()}, nil
+	}
+	if et.Kind() == reflect.Struct {
+		fields := structFields(et)
+		cols := make([]*K, len(fields))
+		for i, f := range fields {
+			col := reflect.MakeSlice(reflect.SliceOf(f.Type), v.Len(), v.Len())
+			for j := 0; j < v.Len(); j++ {
+				col.Index(j).Set(v.Index(j).FieldByIndex(f.Index))
+			}
+			kc, err := toK(col)
+			if err != nil {
+				return nil, err
+			}
+			cols[i] = kc
+		}
+		return NewTable(columnNames(fields), cols), nil
+	}
+	list := make([]*K, v.Len())
+	for i := range list {
+		e, err := toK(v.Index(i))
+		if err != nil {
+			return nil, err
+		}
+		list[i] = orIdentity(e)
+	}
+	return NewList(list...), nil
+}
+
+// structFields returns exported fields of struct type t
+func structFields(t reflect.Type) []reflect.StructField {
+	var fields []reflect.StructField
+	for i := 0; i < t.NumField(); i++ {
+		if f := t.Field(i); f.PkgPath == "" {
+			fields = append(fields, f)
+		}
+	}
+	return fields
+}
+
+// columnNames lowercases initials of field names, UnmarshalDict reverses it
+func columnNames(fields []reflect.StructField) []string {
+	names := make([]string, len(fields))
+	for i, f := range fields {
+		r := []rune(f.Name)
+		r[0] = unicode.ToLower(r[0])
+		names[i] = string(r)
+	}
+	return names
+}
+
+func orIdentity(k *K) *K {
+	if k == nil {
+		return identity
+	}
+	return k
+}
@@ -0,0 +1,118 @@
+package kdb
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type quote struct {
+	Sym   string
+	Price float64
+	Size  int64
+}
+
+func testRegistry(t *testing.T) *Registry {
+	r := NewRegistry()
+	funcs := map[string]interface{}{
+		"add": func(a, b int) int { return a + b },
+		"fetchQuote": func(ctx context.Context, sym string, date time.Time) (quote, error) {
+			if sym == "" {
+				return quote{}, errors.New("nosym")
+			}
+			return quote{sym, 100.5, 10}, nil
+		},
+		"quotes": func(syms []string) []quote {
+			res := make([]quote, len(syms))
+			for i, s := range syms {
+				res[i] = quote{Sym: s}
+			}
+			return res
+		},
+		"sum":   func(x []float64) float64 { return x[0] + x[1] },
+		"raw":   func(x *K) *K { return x },
+		"fail":  func() error { return errors.New("failed") },
+		"store": func(q quote) string { return q.Sym },
+		"now":   func() int64 { return 42 },
+	}
+	for name, fn := range funcs {
+		if err := r.Register(name, fn); err != nil {
+			t.Fatal("Failed to register", name, err)
+		}
+	}
+	return r
+}
+
+func TestRegistry(t *testing.T) {
+	r := testRegistry(t)
+	day := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		call     *K
+		expected *K
+	}{
+		{NewList(Symbol("add"), Long(1), Int(2)), Long(3)},
+		{NewList(&K{KC, NONE, "add"}, Long(1), Long(2)), Long(3)},
+		{NewList(Symbol("fetchQuote"), Symbol("AAPL"), &K{-KP, NONE, day}),
+			NewDict(SymbolV([]string{"sym", "price", "size"}), NewList(Symbol("AAPL"), Float(100.5), Long(10)))},
+		{NewList(Symbol("fetchQuote"), Symbol("AAPL"), DateAtom(day)),
+			NewDict(SymbolV([]string{"sym", "price", "size"}), NewList(Symbol("AAPL"), Float(100.5), Long(10)))},
+		{NewList(Symbol("quotes"), SymbolV([]string{"a", "b"})),
+			NewTable([]string{"sym", "price", "size"}, []*K{SymbolV([]string{"a", "b"}), FloatV([]float64{0, 0}), LongV([]int64{0, 0})})},
+		{NewList(Symbol("sum"), LongV([]int64{1, 2})), Float(3)},
+		{NewList(Symbol("raw"), Symbol("x")), Symbol("x")},
+		{NewList(Symbol("store"), NewDict(SymbolV([]string{"sym"}), NewList(Symbol("y")))), Symbol("y")},
+		{Symbol("now"), Long(42)},
+		{NewList(Symbol("now"), identity), Long(42)},
+		{NewList(Symbol("fail")), nil},
+	}
+	for _, tt := range tests {
+		res, err := r.ServeKDB(context.Background(), nil, SYNC, tt.call)
+		if err != nil && tt.expected != nil {
+			t.Errorf("Call %v failed: %v", tt.call, err)
+			continue
+		}
+		if !reflect.DeepEqual(res, tt.expected) {
+			t.Errorf("Call %v returned %v, expected %v", tt.call, res, tt.expected)
+		}
+	}
+}
+
+func TestRegistryErrors(t *testing.T) {
+	r := testRegistry(t)
+	for _, call := range []*K{
+		NewList(Symbol("fetchQuote"), Symbol(""), &K{-KP, NONE, time.Time{}}),
+		NewList(Symbol("add"), Long(1)),
+		NewList(Symbol("add"), Symbol("a"), Long(1)),
+		NewList(Symbol("unknown")),
+		NewList(Long(1), Long(2)),
+		Long(1),
+	} {
+		if _, err := r.ServeKDB(context.Background(), nil, SYNC, call); err == nil {
+			t.Errorf("Call %v should fail", call)
+		}
+	}
+	if err := r.Register("notfunc", 1); err == nil {
+		t.Error("Registering non-function should fail")
+	}
+	if err := r.Register("badresult", func() (int, int) { return 0, 0 }); err == nil {
+		t.Error("Registering function with two results should fail")
+	}
+}
+
+func TestServerRegistry(t *testing.T) {
+	_, port := testServer(t, testRegistry(t))
+	con, err := DialKDB("localhost", port, "")
+	if err != nil {
+		t.Fatal("Failed to connect:", err)
+	}
+	defer con.Close()
+	res, err := con.Call("add", Long(40), Long(2))
+	if err != nil || res.Data.(int64) != 42 {
+		t.Error("Unexpected result", res, err)
+	}
+	if _, err = con.Call("fail", identity); err != QError("failed") {
+		t.Error("Expected error from function, got", err)
+	}
+}
@@ -0,0 +1,435 @@
+package kdb
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ErrServerClosed is returned by Server.Serve after Close
+var ErrServerClosed = errors.New("Server closed")
+
+// Limits of messages received by Server unless configured otherwise,
+// so that clients cannot exhaust memory or stack of the goroutine decoding them
+const (
+	DefaultMaxMessageSize = 256 << 20
+	DefaultMaxAlloc       = 1 << 30
+	DefaultMaxDepth       = 1000
+)
+
+// ErrDeferred is returned by Handler which responds to synchronous request later with
+// ServerConn.WriteMessage(RESPONSE, res), e.g. to keep the response in order with asynchronous
+// messages written by another goroutine. It is like -30!(::) in q.
+var ErrDeferred = errors.New("Response deferred")
+
+// Handler responds to messages received from q clients.
+// Result of synchronous request is sent back to the client, returned error is sent as q error.
+// Result of asynchronous messages is discarded. Messages cannot be written to c for queries received over HTTP,
+// see QueryHandler.
+type Handler interface {
+	ServeKDB(ctx context.Context, c *ServerConn, msgtype ReqType, data *K) (*K, error)
+}
+
+// HandlerFunc adapts function to Handler
+type HandlerFunc func(ctx context.Context, c *ServerConn, msgtype ReqType, data *K) (*K, error)
+
+// ServeKDB calls f(ctx, c, msgtype, data)
+func (f HandlerFunc) ServeKDB(ctx context.Context, c *ServerConn, msgtype ReqType, data *K) (*K, error) {
+	return f(ctx, c, msgtype, data)
+}
+
+// identity is q generic null (::) sent in response when handler returns no result
+var identity = &K{KFUNCUP, NONE, byte(0)}
+
+// Server accepts connections from q clients and dispatches received messages to Handler
+type Server struct {
+	// Handler is invoked for every message received
+	Handler Handler
+	// Authenticator verifies credentials of connecting clients. All clients are accepted if nil.
+	Authenticator Authenticator
+	// ErrorLog logs errors while accepting or serving connections. Standard logger is used if nil.
+	ErrorLog *log.Logger
+	// HTTPHandler serves HTTP requests received on the same port as IPC, like .z.ph and .z.pp in q.
+	// QueryHandler is used if nil. WebSocket upgrade requests are always served by WebSocketHandler.
+	HTTPHandler http.Handler
+	// Compression decides whether messages sent to clients are compressed. CompressDefault is used if nil.
+	Compression CompressionPolicy
+	// DecodeOptions limits resources used to decode messages from clients.
+	// Connection is closed when a message exceeds them. MaxMessageSize, MaxAlloc and MaxDepth are
+	// DefaultMaxMessageSize, DefaultMaxAlloc and DefaultMaxDepth if zero, negative disables them.
+	DecodeOptions DecodeOptions
+	// CompressionStats accumulates compression metrics of messages sent to clients if not nil
+	CompressionStats *CompressionStats
+	// HandshakeTimeout limits time a client may take to connect before sending first message,
+	// so that idle connections do not hold resources. 30 seconds is used if zero, negative disables the limit.
+	// It also limits time to read headers of HTTP requests and idle time between them.
+	HandshakeTimeout time.Duration
+
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[*ServerConn]struct{}
+	http      *http.Server
+	httpConns *connListener
+	closed    bool
+}
+
+// ServerConn is a connection accepted by Server
+type ServerConn struct {
+	conn net.Conn
+	// addr of HTTP client, which has no conn
+	addr       net.Addr
+	user       string
+	rbuf       *bufio.Reader
+	capability byte
+	// compress decides whether outgoing message should be compressed, CompressDefault if nil
+	compress CompressionPolicy
+	// local is set when client runs on the same host
+	local bool
+	stats *CompressionStats
+	wmu   sync.Mutex // serialises writes
+}
+
+// RemoteAddr returns address of the client
+func (c *ServerConn) RemoteAddr() net.Addr {
+	if c.conn == nil {
+		return c.addr
+	}
+	return c.conn.RemoteAddr()
+}
+
+// User returns name of the user sent by the client during handshake
+func (c *ServerConn) User() string {
+	return c.user
+}
+
+// Capability returns IPC capability agreed with the client during handshake
+func (c *ServerConn) Capability() byte {
+	return c.capability
+}
+
+// errHTTPClient is returned when writing to HTTP client, which receives only the result of its query
+var errHTTPClient = errors.New("Cannot send messages to HTTP client")
+
+// WriteMessage sends message to the client, e.g. asynchronous update to subscriber
+func (c *ServerConn) WriteMessage(msgtype ReqType, data *K) error {
+	if c.conn == nil {
+		return errHTTPClient
+	}
+	e := Encoder{Capability: c.capability, Compression: c.compress, Local: c.local, Stats: c.stats}
+	if e.Compression == nil {
+		e.Compression = CompressDefault
+	}
+	b, err := e.Marshal(msgtype, data)
+	if err != nil {
+		return err
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	_, err = c.conn.Write(b)
+	return err
+}
+
+// Close closes connection to the client
+func (c *ServerConn) Close() error {
+	if c.conn == nil {
+		return nil
+	}
+	return c.conn.Close()
+}
+
+// ListenAndServe listens on TCP address addr and serves incoming connections
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts connections on l and serves each of them in a new goroutine.
+// Any listener can be used, e.g. TCP, unix domain socket or one created by tls.NewListener.
+func (s *Server) Serve(l net.Listener) error {
+	if !s.track(l) {
+		l.Close()
+		return ErrServerClosed
+	}
+	defer s.untrack(l)
+	var delay time.Duration
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
+			if isTemporary(err) {
+				// back off on temporary errors like running out of file descriptors
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else if delay *= 2; delay > time.Second {
+					delay = time.Second
+				}
+				s.logf("kdb: accept error: %v; retrying in %v", err, delay)
+				time.Sleep(delay)
+				continue
+			}
+			return err
+		}
+		delay = 0
+		go s.ServeConn(conn)
+	}
+}
+
+// ServeConn performs q handshake and serves messages on a single connection until it is closed.
+// Like q, connections starting with HTTP request are served as HTTP or WebSocket.
+func (s *Server) ServeConn(conn net.Conn) {
+	defer conn.Close()
+	if tc, ok := conn.(*net.TCPConn); ok {
+		tc.SetKeepAlive(true)
+		tc.SetNoDelay(true)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	timeout := s.handshakeTimeout()
+	hctx := ctx
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+		var hcancel context.CancelFunc
+		hctx, hcancel = context.WithTimeout(ctx, timeout)
+		defer hcancel()
+	}
+	rbuf := bufio.NewReaderSize(conn, 4*1024*1024)
+	if isHTTP(rbuf) {
+		conn.SetDeadline(time.Time{})
+		s.serveHTTP(&peekedConn{Conn: conn, r: rbuf})
+		return
+	}
+	user, capability, err := serverHandshake(hctx, conn, rbuf, s.Authenticator)
+	if err != nil {
+		s.logf("kdb: handshake with %v failed: %v", conn.RemoteAddr(), err)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	s.serve(ctx, &ServerConn{
+		conn:       conn,
+		rbuf:       rbuf,
+		user:       user,
+		capability: capability,
+		compress:   s.Compression,
+		local:      isLocal(conn.RemoteAddr()),
+		stats:      s.CompressionStats,
+	})
+}
+
+// isTemporary reports whether accept error is transient, same as net/http does
+func isTemporary(err error) bool {
+	if errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE) || errors.Is(err, syscall.ECONNABORTED) {
+		return true
+	}
+	ne, ok := err.(net.Error)
+	return ok && ne.Temporary()
+}
+
+// isLocal reports whether addr is on the same host
+func isLocal(addr net.Addr) bool {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP.IsLoopback()
+	case *net.UnixAddr:
+		return true
+	}
+	return false
+}
+
+// handshakeTimeout returns HandshakeTimeout or its default, zero if the limit is disabled
+func (s *Server) handshakeTimeout() time.Duration {
+	switch {
+	case s.HandshakeTimeout == 0:
+		return defaultHandshakeTimeout
+	case s.HandshakeTimeout < 0:
+		return 0
+	}
+	return s.HandshakeTimeout
+}
+
+// serve dispatches messages received on c after handshake until connection is closed
+func (s *Server) serve(ctx context.Context, c *ServerConn) {
+	if !s.trackConn(c) {
+		return
+	}
+	defer s.untrackConn(c)
+	conn := c.conn
+	ctx = context.WithValue(ctx, userKey{}, c.user)
+	opts := s.decodeOptions()
+	for {
+		data, msgtype, err := opts.Decode(c.rbuf)
+		if err != nil {
+			if err != io.EOF && !s.isClosed() {
+				s.logf("kdb: failed to read message from %v: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		res, err := s.handle(ctx, c, msgtype, data)
+		if err == ErrDeferred {
+			continue
+		}
+		if msgtype != SYNC {
+			if err != nil {
+				s.logf("kdb: async message from %v failed: %v", conn.RemoteAddr(), err)
+			}
+			continue
+		}
+		if err != nil {
+			res = Error(err)
+		} else if res == nil {
+			res = identity
+		}
+		if err = c.WriteMessage(RESPONSE, res); err != nil {
+			if _, ok := err.(*CapabilityError); !ok && err != ErrTooLarge {
+				return
+			}
+			c.WriteMessage(RESPONSE, Error(err))
+		}
+	}
+}
+
+// decodeOptions returns DecodeOptions with default limits in place of zero ones
+func (s *Server) decodeOptions() DecodeOptions {
+	opts := s.DecodeOptions
+	if opts.MaxMessageSize == 0 {
+		opts.MaxMessageSize = DefaultMaxMessageSize
+	}
+	if opts.MaxAlloc == 0 {
+		opts.MaxAlloc = DefaultMaxAlloc
+	}
+	if opts.MaxDepth == 0 {
+		opts.MaxDepth = DefaultMaxDepth
+	}
+	return opts
+}
+
+// handle invokes handler converting panics to errors
+func (s *Server) handle(ctx context.Context, c *ServerConn, msgtype ReqType, data *K) (res *K, err error) {
+	if s.Handler == nil {
+		if msgtype == SYNC {
+			return nil, ErrSyncRequest
+		}
+		return nil, nil
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			s.logf("kdb: panic serving %v: %v", c.RemoteAddr(), r)
+			res, err = nil, errors.New("panic")
+		}
+	}()
+	return s.Handler.ServeKDB(ctx, c, msgtype, data)
+}
+
+// Close stops listeners and closes all active connections
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	var err error
+	for l := range s.listeners {
+		if cerr := l.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	for c := range s.conns {
+		c.Close()
+	}
+	if s.http != nil {
+		s.http.Close()
+	}
+	return err
+}
+
+func (s *Server) logf(format string, args ...interface{}) {
+	if s.ErrorLog != nil {
+		s.ErrorLog.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+func (s *Server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+func (s *Server) track(l net.Listener) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	if s.listeners == nil {
+		s.listeners = make(map[net.Listener]struct{})
+	}
+	s.listeners[l] = struct{}{}
+	return true
+}
+
+func (s *Server) untrack(l net.Listener) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.listeners, l)
+}
+
+func (s *Server) trackConn(c *ServerConn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	if s.conns == nil {
+		s.conns = make(map[*ServerConn]struct{})
+	}
+	s.conns[c] = struct{}{}
+	return true
+}
+
+func (s *Server) untrackConn(c *ServerConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, c)
+}
+
+// serverHandshake reads client credentials terminated by 0, authenticates them and replies with agreed capability.
+// Clients prior to v2.6 do not send capability byte.
+// Connection is closed without reply if authentication fails, same as q does.
+func serverHandshake(ctx context.Context, conn net.Conn, rbuf *bufio.Reader, auth Authenticator) (string, byte, error) {
+	cred, err := rbuf.ReadSlice(0)
+	if err != nil {
+		return "", 0, err
+	}
+	cred = cred[:len(cred)-1]
+	var capability byte
+	if n := len(cred); n > 0 && cred[n-1] <= CapabilityLarge {
+		capability = cred[n-1]
+		cred = cred[:n-1]
+	}
+	if capability > DefaultCapability {
+		capability = DefaultCapability
+	}
+	user, password := string(cred), ""
+	if i := bytes.IndexByte(cred, ':'); i >= 0 {
+		user, password = string(cred[:i]), string(cred[i+1:])
+	}
+	if auth != nil {
+		if err = auth.Authenticate(ctx, user, password); err != nil {
+			return "", 0, err
+		}
+	}
+	_, err = conn.Write([]byte{capability})
+	return user, capability, err
+}
@@ -0,0 +1,342 @@
+package kdb
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/nu7hatch/gouuid"
+)
+
+// startServer serves on l in background and closes server at the end of the test
+func startServer(t *testing.T, s *Server, l net.Listener) {
+	if s.ErrorLog == nil {
+		s.ErrorLog = log.New(io.Discard, "", 0)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Serve(l)
+	}()
+	t.Cleanup(func() {
+		s.Close()
+		if err := <-done; err != ErrServerClosed {
+			t.Error("Serve returned unexpected error:", err)
+		}
+	})
+}
+
+func testServer(t *testing.T, h Handler) (*Server, int) {
+	return serveTCP(t, &Server{Handler: h})
+}
+
+// serveTCP serves s on random localhost port
+func serveTCP(t *testing.T, s *Server) (*Server, int) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal("Failed to listen:", err)
+	}
+	startServer(t, s, ln)
+	return s, ln.Addr().(*net.TCPAddr).Port
+}
+
+// echoHandler returns arguments of sync calls and reports async messages
+func echoHandler(async chan *K) Handler {
+	return HandlerFunc(func(ctx context.Context, c *ServerConn, msgtype ReqType, data *K) (*K, error) {
+		if msgtype != SYNC {
+			async <- data
+			return nil, nil
+		}
+		args := data.Data.([]*K)
+		switch args[0].Data.(string) {
+		case "fail":
+			return nil, errors.New("failed")
+		case "nil":
+			return nil, nil
+		case "panic":
+			panic("boom")
+		}
+		return args[1], nil
+	})
+}
+
+func TestServer(t *testing.T) {
+	async := make(chan *K, 1)
+	_, port := testServer(t, echoHandler(async))
+	con, err := DialKDB("localhost", port, "user:pwd")
+	if err != nil {
+		t.Fatal("Failed to connect:", err)
+	}
+	defer con.Close()
+	if con.Capability() != DefaultCapability {
+		t.Error("Unexpected capability", con.Capability())
+	}
+	res, err := con.Call("echo", Long(42))
+	if err != nil || res.Data.(int64) != 42 {
+		t.Error("Unexpected echo result", res, err)
+	}
+	if _, err = con.Call("fail", Long(1)); err != QError("failed") {
+		t.Error("Expected handler error, got", err)
+	}
+	if _, err = con.Call("panic", Long(1)); err == nil {
+		t.Error("Panic in handler should be reported as error")
+	}
+	if res, err = con.Call("nil", Long(1)); err != nil || res.Type != KFUNCUP {
+		t.Error("Expected generic null, got", res, err)
+	}
+	if err = con.AsyncCall("upd", Symbol("x")); err != nil {
+		t.Fatal("Async call failed", err)
+	}
+	select {
+	case data := <-async:
+		if data.Data.([]*K)[1].Data.(string) != "x" {
+			t.Error("Unexpected async message", data)
+		}
+	case <-time.After(time.Second):
+		t.Error("Async message was not handled")
+	}
+}
+
+func TestServerCapability(t *testing.T) {
+	_, port := testServer(t, echoHandler(nil))
+	con, err := dialCapability(t, port, CapabilityV26)
+	if err != nil {
+		t.Fatal("Failed to connect:", err)
+	}
+	defer con.Close()
+	if con.Capability() != CapabilityV26 {
+		t.Error("Server did not agree on requested capability", con.Capability())
+	}
+	if _, err = con.Call("echo", &K{-UU, NONE, uuid.UUID{}}); err == nil {
+		t.Error("Guid should not be sent to v2.6 client")
+	}
+}
+
+func TestServerCompression(t *testing.T) {
+	serverStats, clientStats := new(CompressionStats), new(CompressionStats)
+	_, port := serveTCP(t, &Server{Handler: echoHandler(nil), Compression: CompressAlways, CompressionStats: serverStats})
+	con, err := Dial(context.Background(), net.JoinHostPort("localhost", strconv.Itoa(port)), WithCompressionStats(clientStats))
+	if err != nil {
+		t.Fatal("Failed to connect:", err)
+	}
+	defer con.Close()
+	if res, err := con.Call("echo", &K{KB, NONE, make([]bool, 4000)}); err != nil || res.Len() != 4000 {
+		t.Fatal("Call failed", err)
+	}
+	// client does not compress for local server by default
+	if clientStats.Messages() != 1 || clientStats.Compressed() != 0 || clientStats.Saved() != 0 {
+		t.Errorf("Unexpected client stats %+v", *clientStats)
+	}
+	if serverStats.Messages() != 1 || serverStats.Compressed() != 1 || serverStats.Saved() <= 0 {
+		t.Errorf("Unexpected server stats %+v", *serverStats)
+	}
+}
+
+func TestServerDecodeLimits(t *testing.T) {
+	_, port := serveTCP(t, &Server{Handler: echoHandler(nil), DecodeOptions: DecodeOptions{MaxVectorLength: 100}})
+	con, err := Dial(context.Background(), net.JoinHostPort("localhost", strconv.Itoa(port)))
+	if err != nil {
+		t.Fatal("Failed to connect:", err)
+	}
+	defer con.Close()
+	if _, err = con.Call("echo", LongV(make([]int64, 100))); err != nil {
+		t.Fatal("Call within limits failed", err)
+	}
+	if _, err = con.Call("echo", LongV(make([]int64, 101))); err == nil {
+		t.Error("Server should close connection on message exceeding limits")
+	}
+}
+
+// dialCapability connects to localhost port requesting capability
+func dialCapability(t *testing.T, port int, capability byte) (*KDBConn, error) {
+	return Dial(context.Background(), net.JoinHostPort("localhost", strconv.Itoa(port)), WithCapability(capability))
+}
+
+func TestServerTLS(t *testing.T) {
+	ln, err := tls.Listen("tcp", "localhost:0", testTLSConfig())
+	if err != nil {
+		t.Fatal("Failed to listen:", err)
+	}
+	startServer(t, &Server{Handler: echoHandler(nil)}, ln)
+	con, err := Dial(context.Background(), ln.Addr().String(), WithTLS(&tls.Config{InsecureSkipVerify: true}))
+	if err != nil {
+		t.Fatal("Failed to connect via TLS:", err)
+	}
+	defer con.Close()
+	if res, err := con.Call("echo", Int(1)); err != nil || res.Data.(int32) != 1 {
+		t.Error("Call via TLS failed", res, err)
+	}
+}
+
+func TestServerUnix(t *testing.T) {
+	port := 40000 + time.Now().Nanosecond()%10000
+	path, err := unixSocketPath(strconv.Itoa(port))
+	if err != nil {
+		t.Skip(err)
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal("Failed to listen:", err)
+	}
+	startServer(t, &Server{Handler: echoHandler(nil)}, ln)
+	con, err := DialUnix("localhost", port, "")
+	if err != nil {
+		t.Fatal("Failed to connect via unix socket:", err)
+	}
+	defer con.Close()
+	if res, err := con.Call("echo", Symbol("a")); err != nil || res.Data.(string) != "a" {
+		t.Error("Call via unix socket failed", res, err)
+	}
+}
+
+func TestServerClose(t *testing.T) {
+	s, port := testServer(t, echoHandler(nil))
+	con, err := DialKDB("localhost", port, "")
+	if err != nil {
+		t.Fatal("Failed to connect:", err)
+	}
+	defer con.Close()
+	s.Close()
+	if _, err = con.Call("echo", Long(1)); err == nil {
+		t.Error("Connection should be closed with server")
+	}
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal("Failed to listen:", err)
+	}
+	if err = s.Serve(ln); err != ErrServerClosed {
+		t.Error("Serve should fail after Close, got", err)
+	}
+}
+
+// flakyListener fails the first accepts with errors of running out of file descriptors
+type flakyListener struct {
+	net.Listener
+	failures int
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	if l.failures > 0 {
+		l.failures--
+		return nil, &net.OpError{Op: "accept", Net: "tcp", Err: os.NewSyscallError("accept", syscall.EMFILE)}
+	}
+	return l.Listener.Accept()
+}
+
+func TestServerAcceptBackoff(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal("Failed to listen:", err)
+	}
+	startServer(t, &Server{Handler: echoHandler(nil)}, &flakyListener{Listener: ln, failures: 3})
+	con, err := Dial(context.Background(), ln.Addr().String())
+	if err != nil {
+		t.Fatal("Failed to connect:", err)
+	}
+	defer con.Close()
+	if res, err := con.Call("echo", Long(1)); err != nil || res.Data != int64(1) {
+		t.Error("Server should keep accepting after EMFILE, got", res, err)
+	}
+}
+
+func TestServerHandshakeTimeout(t *testing.T) {
+	_, port := serveTCP(t, &Server{Handler: echoHandler(nil), HandshakeTimeout: 50 * time.Millisecond})
+	conn, err := net.Dial("tcp", "localhost:"+strconv.Itoa(port))
+	if err != nil {
+		t.Fatal("Failed to connect:", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err = conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Error("Idle connection should be closed by server, got", err)
+	}
+}
+
+func TestHandleClientConnection(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal("Failed to listen:", err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			HandleClientConnection(conn)
+		}
+	}()
+	con, err := Dial(context.Background(), ln.Addr().String())
+	if err != nil {
+		t.Fatal("Failed to connect:", err)
+	}
+	defer con.Close()
+	if _, err = con.Call("til", Long(1)); err != QError(ErrSyncRequest.Error()) {
+		t.Error("Expected sync request error, got", err)
+	}
+}
+
+func TestServerDeferredResponse(t *testing.T) {
+	_, port := testServer(t, HandlerFunc(func(ctx context.Context, c *ServerConn, msgtype ReqType, data *K) (*K, error) {
+		go func() {
+			c.WriteMessage(ASYNC, Symbol("first"))
+			c.WriteMessage(RESPONSE, data)
+		}()
+		return nil, ErrDeferred
+	}))
+	con, err := DialKDB("localhost", port, "")
+	if err != nil {
+		t.Fatal("Failed to connect:", err)
+	}
+	defer con.Close()
+	if err = con.WriteMessage(SYNC, Long(1)); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []ReqType{ASYNC, RESPONSE} {
+		res, msgtype, err := con.ReadMessage()
+		if err != nil || msgtype != expected {
+			t.Fatal("Unexpected message", res, msgtype, err)
+		}
+	}
+}
+
+func TestServerMaxMessageSize(t *testing.T) {
+	_, port := testServer(t, echoHandler(nil))
+	con, err := DialKDB("localhost", port, "")
+	if err != nil {
+		t.Fatal("Failed to connect:", err)
+	}
+	defer con.Close()
+	// header of message claiming more than DefaultMaxMessageSize bytes
+	hdr := []byte{1, byte(SYNC), 0, 0, 0, 0, 0, 0}
+	binary.LittleEndian.PutUint32(hdr[4:], DefaultMaxMessageSize+1)
+	if _, err = con.con.Write(hdr); err != nil {
+		t.Fatal("Failed to write header:", err)
+	}
+	con.con.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err = con.rbuf.ReadByte(); err != io.EOF {
+		t.Error("Connection should be closed by server, got", err)
+	}
+}
+
+func TestServerMaxDepth(t *testing.T) {
+	_, port := testServer(t, echoHandler(make(chan *K, 1)))
+	con, err := DialKDB("localhost", port, "")
+	if err != nil {
+		t.Fatal("Failed to connect:", err)
+	}
+	defer con.Close()
+	if _, err = con.Call("echo", nested(DefaultMaxDepth-1)); err != nil {
+		t.Fatal("Call within depth limit failed:", err)
+	}
+	// connection is closed by server
+	if _, err = con.Call("echo", nested(DefaultMaxDepth)); err == nil {
+		t.Error("Expected nesting beyond DefaultMaxDepth to fail")
+	}
+}
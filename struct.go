@@ -80,6 +80,13 @@ const (
 	KERR int8 = -128 // indicates error with 0 terminated string as a text
 )
 
+// Messages larger than largeMessageSize are sent only to peers with CapabilityLarge.
+// Their size takes 5 bytes of the header and vector lengths take 8 bytes.
+var largeMessageSize int64 = math.MaxInt32
+
+// maxMessageSize is the largest message which size fits 5 bytes
+const maxMessageSize = 1<<40 - 1
+
 type ipcHeader struct {
 	ByteOrder   byte
 	RequestType ReqType
@@ -180,13 +187,13 @@ func SymbolV(x []string) *K {
 	return &K{KS, NONE, x}
 }
 
-// Date wraps time.Time as K
-func Date(x time.Time) *K {
-	return &K{-KD, NONE, x}
+// DateAtom wraps date of x as K
+func DateAtom(x time.Time) *K {
+	return &K{-KD, NONE, NewDate(x)}
 }
 
-// DateV wraps time.Time slice as K
-func DateV(x []time.Time) *K {
+// DateV wraps Date slice as K, see NewDates for time.Time slice
+func DateV(x []Date) *K {
 	return &K{KD, NONE, x}
 }
 
@@ -310,44 +317,182 @@ var ErrBadMsg = errors.New("Bad Message")
 // ErrBadHeader to indicate invalid header
 var ErrBadHeader = errors.New("Bad header")
 
+// ErrAuthFailed to indicate that server rejected credentials during handshake
+var ErrAuthFailed = errors.New("Authentication failed")
+
+// ErrTooLarge to indicate that message exceeds size supported by the peer
+var ErrTooLarge = errors.New("Message is too large")
+
 // ErrSyncRequest cannot process sync requests
 var ErrSyncRequest = errors.New("nosyncrequest")
 
+// QError is an error returned by the remote q process, e.g. 'type
+type QError string
+
+func (e QError) Error() string {
+	return string(e)
+}
+
 // Epoch offset for Q time. Q epoch starts on 1st Jan 2000
 var qEpoch = time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
 
-// Month represents a month type in kdb
+// Month represents a month type in kdb as months since 2000.01m
 type Month int32
 
+// NewMonth returns month containing t
+func NewMonth(t time.Time) Month {
+	return Month((t.Year()-2000)*12 + int(t.Month()) - 1)
+}
+
+// Time returns first day of month m
+func (m Month) Time() time.Time {
+	return qEpoch.AddDate(0, int(m), 0)
+}
+
 func (m Month) String() string {
-	return fmt.Sprintf("%v.%02vm", 2000+int(m/12), int(m)%12)
+	switch int32(m) {
+	case Ni:
+		return "0Nm"
+	case Wi:
+		return "0Wm"
+	case -Wi:
+		return "-0Wm"
+	}
+	t := m.Time()
+	return fmt.Sprintf("%v.%02vm", t.Year(), int(t.Month()))
 }
 
-// Minute represents a minute type in kdb
+// Date represents date type in kdb as midnight UTC
+type Date time.Time
+
+// NewDate returns date of t in its location
+func NewDate(t time.Time) Date {
+	return Date(time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC))
+}
+
+// NewDates returns dates of ts, e.g. for DateV
+func NewDates(ts []time.Time) []Date {
+	v := make([]Date, len(ts))
+	for i, t := range ts {
+		v[i] = NewDate(t)
+	}
+	return v
+}
+
+// Time returns midnight UTC of date d
+func (d Date) Time() time.Time {
+	return time.Time(d)
+}
+
+func (d Date) String() string {
+	if s, ok := specialString(time.Time(d), "d"); ok {
+		return s
+	}
+	return time.Time(d).Format("2006.01.02")
+}
+
+// Timespan represents timespan type in kdb as nanoseconds
+type Timespan time.Duration
+
+// Duration returns timespan as time.Duration
+func (n Timespan) Duration() time.Duration {
+	return time.Duration(n)
+}
+
+func (n Timespan) String() string {
+	switch int64(n) {
+	case Nj:
+		return "0Nn"
+	case Wj:
+		return "0Wn"
+	case -Wj:
+		return "-0Wn"
+	}
+	d, sign := time.Duration(n), ""
+	if d < 0 {
+		d, sign = -d, "-"
+	}
+	return fmt.Sprintf("%s%dD%02d:%02d:%02d.%09d", sign, d/day, d%day/time.Hour, d%time.Hour/time.Minute,
+		d%time.Minute/time.Second, d%time.Second)
+}
+
+// Minute represents a minute type in kdb - hh:mm, as time of day on 2000.01.01
 type Minute time.Time
 
+// NewMinute returns minute d after midnight, truncated to whole minutes
+func NewMinute(d time.Duration) Minute {
+	return Minute(qEpoch.Add(d.Truncate(time.Minute)))
+}
+
+// Duration returns time since midnight
+func (m Minute) Duration() time.Duration {
+	return time.Time(m).Sub(qEpoch)
+}
+
 func (m Minute) String() string {
+	if s, ok := specialString(time.Time(m), "u"); ok {
+		return s
+	}
 	time := time.Time(m)
 	return fmt.Sprintf("%02v:%02v", time.Hour(), time.Minute())
 
 }
 
-// Second represents a second type in kdb - hh:mm:ss
+// Second represents a second type in kdb - hh:mm:ss, as time of day on 2000.01.01
 type Second time.Time
 
+// NewSecond returns second d after midnight, truncated to whole seconds
+func NewSecond(d time.Duration) Second {
+	return Second(qEpoch.Add(d.Truncate(time.Second)))
+}
+
+// Duration returns time since midnight
+func (s Second) Duration() time.Duration {
+	return time.Time(s).Sub(qEpoch)
+}
+
 func (s Second) String() string {
+	if str, ok := specialString(time.Time(s), "v"); ok {
+		return str
+	}
 	time := time.Time(s)
 	return fmt.Sprintf("%02v:%02v:%02v", time.Hour(), time.Minute(), time.Second())
 }
 
-// Time represents time type in kdb - hh:mm:ss.SSS
+// Time represents time type in kdb - hh:mm:ss.SSS, as time of day on 2000.01.01
 type Time time.Time
 
+// NewTime returns time d after midnight, truncated to whole milliseconds
+func NewTime(d time.Duration) Time {
+	return Time(qEpoch.Add(d.Truncate(time.Millisecond)))
+}
+
+// Duration returns time since midnight
+func (t Time) Duration() time.Duration {
+	return time.Time(t).Sub(qEpoch)
+}
+
 func (t Time) String() string {
+	if s, ok := specialString(time.Time(t), "t"); ok {
+		return s
+	}
 	time := time.Time(t)
 	return fmt.Sprintf("%02v:%02v:%02v.%03v", time.Hour(), time.Minute(), time.Second(), time.Nanosecond()/1000000)
 }
 
+// specialString formats null and infinite time of day as q does, c is q type character
+func specialString(t time.Time, c string) (string, bool) {
+	switch {
+	case t.IsZero():
+		return "0N" + c, true
+	case t.Equal(InfTime):
+		return "0W" + c, true
+	case t.Equal(NegInfTime):
+		return "-0W" + c, true
+	}
+	return "", false
+}
+
 // Table represents table type in kdb
 type Table struct {
 	Columns []string
@@ -421,7 +566,8 @@ func titleInitial(str string) string {
 	return ""
 }
 
-// UnmarshalDict decodes dict to a struct
+// UnmarshalDict decodes dict to a struct.
+// Pointer fields are set to nil for q nulls, sql.Scanner fields such as sql.NullInt64 or Nullable receive nil.
 func UnmarshalDict(t Dict, v interface{}) error {
 	var keys = t.Key.Data.([]string)
 	var vals = t.Value.Data.([]*K)
@@ -433,11 +579,17 @@ func UnmarshalDict(t Dict, v interface{}) error {
 	for i := range keys {
 		val := vals[i].Data
 		fv := vv.FieldByName(titleInitial(keys[i]))
-		if !fv.IsValid() {
+		if !fv.IsValid() || !fv.CanSet() || val == nil {
 			continue
 		}
-		if fv.CanSet() && reflect.TypeOf(val).AssignableTo(fv.Type()) {
+		if vt := reflect.TypeOf(val); vt.AssignableTo(fv.Type()) {
 			fv.Set(reflect.ValueOf(val))
+		} else if sameKind(vt, fv.Type()) {
+			fv.Set(reflect.ValueOf(val).Convert(fv.Type()))
+		} else if isNullable(fv.Type()) {
+			if err := setNullable(fv, vals[i]); err != nil {
+				return fmt.Errorf("%s: %v", keys[i], err)
+			}
 		}
 	}
 	return nil
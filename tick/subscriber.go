@@ -0,0 +1,263 @@
+package tick
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/sv/kdbgo"
+	"github.com/sv/kdbgo/journal"
+)
+
+// Subscriber receives updates from tickerplant the way r.q does.
+// It subscribes when Run is called and again every time the connection is re-established.
+// Callbacks are called from the goroutine running Run, error returned by a callback stops Run.
+type Subscriber struct {
+	// Tables to subscribe to, all tables if empty
+	Tables []string
+	// Syms to receive updates for, all syms if empty
+	Syms []string
+	// Replay enables replaying tickerplant journal (.u.L) up to the current count (.u.i)
+	// before processing live updates
+	Replay bool
+	// LogPath maps journal path reported by tickerplant to local path, e.g. if it is mounted elsewhere
+	LogPath func(path string) string
+
+	// Schema is called with empty table after every subscription, before replay.
+	// Tables should be reset to the schema since updates are replayed from the start of the day.
+	Schema func(table string, schema kdb.Table) error
+	// Upd is called for every update
+	Upd func(table string, data kdb.Table) error
+	// End is called at the end of day (.u.end) with the date that ended
+	End func(date time.Time) error
+
+	conn    *kdb.ReconnectingConn
+	schemas map[string]kdb.Table
+	pending []*kdb.K
+}
+
+// NewSubscriber creates subscriber receiving updates over conn.
+// conn.OnReconnect is used to resubscribe.
+func NewSubscriber(conn *kdb.ReconnectingConn) *Subscriber {
+	s := &Subscriber{conn: conn}
+	conn.OnReconnect = s.subscribe
+	return s
+}
+
+// Run subscribes and dispatches updates until ctx is done, a callback fails
+// or connection gives up reconnecting. Connection is closed when Run returns.
+func (s *Subscriber) Run(ctx context.Context) error {
+	defer s.conn.Close()
+	c, err := s.conn.Conn()
+	if err != nil {
+		return err
+	}
+	if err = s.subscribe(c); err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.conn.Close()
+		case <-done:
+		}
+	}()
+	for {
+		msg, _, err := s.conn.ReadMessage()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		if err = s.dispatch(msg); err != nil {
+			return err
+		}
+	}
+}
+
+// subscribe calls .u.sub for every table, replays journal if configured
+// and dispatches updates received in the meantime
+func (s *Subscriber) subscribe(c *kdb.KDBConn) error {
+	s.pending = nil
+	syms := kdb.Symbol("")
+	if len(s.Syms) > 0 {
+		syms = kdb.SymbolV(s.Syms)
+	}
+	tables := s.Tables
+	if len(tables) == 0 {
+		tables = []string{""}
+	}
+	s.schemas = make(map[string]kdb.Table)
+	for _, t := range tables {
+		res, err := s.call(c, ".u.sub", kdb.Symbol(t), syms)
+		if err != nil {
+			return err
+		}
+		pairs := []*kdb.K{res}
+		if t == "" {
+			pairs = res.Data.([]*kdb.K)
+		}
+		for _, p := range pairs {
+			name, schema, err := parseSchema(p)
+			if err != nil {
+				return err
+			}
+			s.schemas[name] = schema
+			if s.Schema != nil {
+				if err = s.Schema(name, schema); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if s.Replay {
+		// updates received before .u.i response are already in the journal
+		l, err := s.call(c, ".u.L")
+		if err != nil {
+			return err
+		}
+		i, err := s.call(c, ".u.i")
+		if err != nil {
+			return err
+		}
+		if path, ok := l.Data.(string); ok && path != "" {
+			n, ok := i.Data.(int64)
+			if !ok {
+				return errors.New("Unexpected message count " + i.String())
+			}
+			path = strings.TrimPrefix(path, ":")
+			if s.LogPath != nil {
+				path = s.LogPath(path)
+			}
+			if _, err = journal.ReplayN(path, n, s.replay); err != nil {
+				return err
+			}
+			s.pending = nil
+		}
+	}
+	pending := s.pending
+	s.pending = nil
+	for _, msg := range pending {
+		if err := s.dispatch(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// call performs synchronous call keeping updates which arrive before the response
+func (s *Subscriber) call(c *kdb.KDBConn, fn string, args ...*kdb.K) (*kdb.K, error) {
+	msg := &kdb.K{Type: kdb.KC, Attr: kdb.NONE, Data: fn}
+	if len(args) > 0 {
+		msg = kdb.NewList(append([]*kdb.K{msg}, args...)...)
+	}
+	if err := c.WriteMessage(kdb.SYNC, msg); err != nil {
+		return nil, err
+	}
+	for {
+		data, msgtype, err := c.ReadMessage()
+		if err != nil {
+			return nil, err
+		}
+		if msgtype == kdb.RESPONSE {
+			return data, nil
+		}
+		s.pending = append(s.pending, data)
+	}
+}
+
+// parseSchema splits (table;schema) returned by .u.sub
+func parseSchema(p *kdb.K) (string, kdb.Table, error) {
+	if pair, ok := p.Data.([]*kdb.K); ok && len(pair) == 2 && pair[0].Type == -kdb.KS && pair[1].Type == kdb.XT {
+		return pair[0].Data.(string), pair[1].Data.(kdb.Table), nil
+	}
+	return "", kdb.Table{}, errors.New("Unexpected subscription result " + p.String())
+}
+
+// dispatch calls callback for (`upd;table;data) or (`.u.end;date) message
+func (s *Subscriber) dispatch(msg *kdb.K) error {
+	list, ok := msg.Data.([]*kdb.K)
+	if !ok || len(list) < 2 || list[0].Type != -kdb.KS {
+		return nil
+	}
+	switch list[0].Data.(string) {
+	case "upd":
+		if len(list) != 3 || list[1].Type != -kdb.KS || s.Upd == nil {
+			return nil
+		}
+		table := list[1].Data.(string)
+		data, err := s.table(table, list[2])
+		if err != nil {
+			return err
+		}
+		return s.Upd(table, data)
+	case ".u.end":
+		if s.End == nil {
+			return nil
+		}
+		date, err := toDate(list[1])
+		if err != nil {
+			return err
+		}
+		return s.End(date)
+	}
+	return nil
+}
+
+// replay passes journal entry of subscribed table to Upd keeping subscribed syms only
+func (s *Subscriber) replay(table string, data *kdb.K) error {
+	if _, ok := s.schemas[table]; !ok || s.Upd == nil {
+		return nil
+	}
+	tbl, err := s.table(table, data)
+	if err != nil {
+		return err
+	}
+	if len(s.Syms) > 0 {
+		filter := make(map[string]bool)
+		for _, sym := range s.Syms {
+			filter[sym] = true
+		}
+		for i, col := range tbl.Columns {
+			if col != "sym" || tbl.Data[i].Type != kdb.KS {
+				continue
+			}
+			var rows []int
+			for j, sym := range tbl.Data[i].Data.([]string) {
+				if filter[sym] {
+					rows = append(rows, j)
+				}
+			}
+			if len(rows) == 0 {
+				return nil
+			}
+			tbl = selectRows(tbl, rows)
+			break
+		}
+	}
+	return s.Upd(table, tbl)
+}
+
+// table converts update to table using schema of subscribed table
+func (s *Subscriber) table(name string, data *kdb.K) (kdb.Table, error) {
+	if data.Type == kdb.XT {
+		return data.Data.(kdb.Table), nil
+	}
+	schema, ok := s.schemas[name]
+	if !ok {
+		return kdb.Table{}, errors.New("Update of unknown table " + name)
+	}
+	return toTable(name, schema, data)
+}
+
+// toDate converts q date
+func toDate(k *kdb.K) (time.Time, error) {
+	if d, ok := k.Data.(kdb.Date); ok {
+		return d.Time(), nil
+	}
+	return time.Time{}, errors.New("Unexpected date " + k.String())
+}
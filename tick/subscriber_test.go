@@ -0,0 +1,195 @@
+package tick
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sv/kdbgo"
+	"github.com/sv/kdbgo/journal"
+)
+
+type update struct {
+	table string
+	data  kdb.Table
+}
+
+func testSubscriber(t *testing.T, port int) (*Subscriber, chan string, chan update, chan time.Time) {
+	con, err := kdb.DialKDB("localhost", port, "")
+	if err != nil {
+		t.Fatal("Failed to connect:", err)
+	}
+	rc, err := kdb.NewReconnectingConn(con)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc.Backoff = kdb.Backoff{Initial: time.Millisecond, Max: 10 * time.Millisecond, Multiplier: 2}
+	schemas, upds, ends := make(chan string, 10), make(chan update, 10), make(chan time.Time, 1)
+	s := NewSubscriber(rc)
+	s.Schema = func(table string, schema kdb.Table) error {
+		schemas <- table
+		return nil
+	}
+	s.Upd = func(table string, data kdb.Table) error {
+		upds <- update{table, data}
+		return nil
+	}
+	s.End = func(date time.Time) error {
+		ends <- date
+		return nil
+	}
+	return s, schemas, upds, ends
+}
+
+func runSubscriber(t *testing.T, s *Subscriber) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; err != context.Canceled {
+			t.Error("Run returned unexpected error:", err)
+		}
+	})
+}
+
+func expectUpdate(t *testing.T, upds chan update, price float64) {
+	t.Helper()
+	select {
+	case u := <-upds:
+		if u.table != "trade" || u.data.Data[1].Data.([]string)[0] != "AAPL" || u.data.Data[2].Data.([]float64)[0] != price {
+			t.Errorf("Unexpected update %v, expected price %v", u.data, price)
+		}
+		if u.data.Data[1].Len() != 1 {
+			t.Error("Update was not filtered", u.data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Update was not received, expected price", price)
+	}
+}
+
+func trade(sym string, price float64) *kdb.K {
+	return kdb.NewList(kdb.SymbolV([]string{sym, "MSFT"}), kdb.FloatV([]float64{price, 0}), kdb.LongV([]int64{1, 1}))
+}
+
+func TestSubscriberReplay(t *testing.T) {
+	j, err := journal.Create(filepath.Join(t.TempDir(), "trade2024.01.02"))
+	if err != nil {
+		t.Fatal("Failed to create journal:", err)
+	}
+	tp := &Tickerplant{Journal: j}
+	port := startTickerplant(t, tp)
+	for _, price := range []float64{1, 2} {
+		if err = tp.Publish("trade", trade("AAPL", price)); err != nil {
+			t.Fatal("Publishing failed:", err)
+		}
+	}
+	s, schemas, upds, ends := testSubscriber(t, port)
+	s.Tables, s.Syms, s.Replay = []string{"trade"}, []string{"AAPL"}, true
+	runSubscriber(t, s)
+	if table := <-schemas; table != "trade" {
+		t.Error("Unexpected schema", table)
+	}
+	expectUpdate(t, upds, 1)
+	expectUpdate(t, upds, 2)
+	if err = tp.Publish("trade", trade("AAPL", 3)); err != nil {
+		t.Fatal("Publishing failed:", err)
+	}
+	expectUpdate(t, upds, 3)
+	day := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	if err = tp.EndOfDay(day, nil); err != nil {
+		t.Fatal("End of day failed:", err)
+	}
+	select {
+	case date := <-ends:
+		if !date.Equal(day) {
+			t.Error("Unexpected end of day", date)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("End of day was not received")
+	}
+}
+
+func TestSubscriberReplayLive(t *testing.T) {
+	j, err := journal.Create(filepath.Join(t.TempDir(), "trade2024.01.02"))
+	if err != nil {
+		t.Fatal("Failed to create journal:", err)
+	}
+	tp := &Tickerplant{Journal: j}
+	port := startTickerplant(t, tp)
+	// subscribe while large updates are published so that they queue up on tickerplant side,
+	// each should be received exactly once, replayed or live
+	n, rows := 1000, 1000
+	done := make(chan error, 1)
+	go func() {
+		for i := 1; i <= n; i++ {
+			prices := make([]float64, rows)
+			for r := range prices {
+				prices[r] = float64(i)
+			}
+			data := kdb.NewList(kdb.SymbolV(make([]string, rows)), kdb.FloatV(prices), kdb.LongV(make([]int64, rows)))
+			if err := tp.Publish("trade", data); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	for tp.count() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	s, _, upds, _ := testSubscriber(t, port)
+	s.Replay = true
+	s.Schema = func(string, kdb.Table) error {
+		time.Sleep(100 * time.Millisecond)
+		return nil
+	}
+	runSubscriber(t, s)
+	// unblock Upd so that Run can return if the test fails early
+	t.Cleanup(func() {
+		go func() {
+			for range upds {
+			}
+		}()
+	})
+	for i := 1; i <= n; i++ {
+		select {
+		case u := <-upds:
+			if price := u.data.Data[2].Data.([]float64)[0]; price != float64(i) {
+				t.Fatalf("Expected update %v, got %v", i, price)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Update was not received", i)
+		}
+	}
+	if err = <-done; err != nil {
+		t.Fatal("Publishing failed:", err)
+	}
+}
+
+func TestSubscriberResubscribe(t *testing.T) {
+	tp := New()
+	port := startTickerplant(t, tp)
+	s, schemas, upds, _ := testSubscriber(t, port)
+	s.Syms = []string{"AAPL"}
+	runSubscriber(t, s)
+	<-schemas
+	// drop subscriber connection on tickerplant side
+	tp.mu.Lock()
+	for c := range tp.subs {
+		c.Close()
+	}
+	tp.mu.Unlock()
+	select {
+	case <-schemas:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Subscriber did not resubscribe")
+	}
+	if err := tp.Publish("trade", trade("AAPL", 4)); err != nil {
+		t.Fatal("Publishing failed:", err)
+	}
+	expectUpdate(t, upds, 4)
+}
@@ -0,0 +1,419 @@
+// Package tick implements kdb+tick compatible tickerplant and subscriber
+package tick
+
+import (
+	"context"
+	"errors"
+	"log"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sv/kdbgo"
+	"github.com/sv/kdbgo/journal"
+)
+
+// DefaultQueueSize is number of messages buffered for each subscriber unless configured otherwise
+const DefaultQueueSize = 10000
+
+// Tickerplant publishes updates to subscribers the same way tick.q does.
+// It is a kdb.Handler so it can be served by kdb.Server.
+// Subscribers call .u.sub[table;syms] and receive (`upd;table;data) asynchronously.
+// Feed handlers publish with .u.upd[table;data] or Go code calls Publish.
+type Tickerplant struct {
+	// QueueSize limits messages pending for a subscriber. Subscribers falling behind are disconnected
+	// so that they cannot hold back publishing. Defaults to DefaultQueueSize.
+	QueueSize int
+	// ErrorLog logs disconnected subscribers. Standard logger is used if nil.
+	ErrorLog *log.Logger
+	// Journal records updates before they are published so that subscribers can replay them.
+	// It must be set before the tickerplant is served and is replaced by EndOfDay.
+	Journal *journal.Journal
+
+	mu      sync.Mutex
+	schemas map[string]kdb.Table
+	subs    map[*kdb.ServerConn]*subscriber
+	i       int64
+}
+
+// subscriber is a connection subscribed to one or more tables
+type subscriber struct {
+	conn *kdb.ServerConn
+	// syms filters updates per table, nil filter passes all syms
+	tables map[string]map[string]bool
+	queue  chan message
+}
+
+// message is queued for a subscriber
+type message struct {
+	msgtype kdb.ReqType
+	data    *kdb.K
+}
+
+// New creates tickerplant without tables
+func New() *Tickerplant {
+	return &Tickerplant{}
+}
+
+// AddTable declares table published by the tickerplant. schema is an empty table defining columns and types.
+// Like in tick.q, if the first column is of timespan type, updates without it are timestamped on arrival.
+func (tp *Tickerplant) AddTable(name string, schema *kdb.K) error {
+	if schema == nil || schema.Type != kdb.XT {
+		return errors.New("Schema of " + name + " should be a table")
+	}
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	if tp.schemas == nil {
+		tp.schemas = make(map[string]kdb.Table)
+	}
+	tp.schemas[name] = schema.Data.(kdb.Table)
+	return nil
+}
+
+// Tables returns names of published tables
+func (tp *Tickerplant) Tables() []string {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	return tp.tables()
+}
+
+func (tp *Tickerplant) tables() []string {
+	names := make([]string, 0, len(tp.schemas))
+	for name := range tp.schemas {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ServeKDB handles .u.sub and .u.upd calls and queries of .u.t, .u.i and .u.L.
+// Responses to subscribers are queued with their updates, so e.g. .u.i counts exactly the updates received before it.
+func (tp *Tickerplant) ServeKDB(ctx context.Context, c *kdb.ServerConn, msgtype kdb.ReqType, data *kdb.K) (*kdb.K, error) {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	res, err := tp.call(ctx, c, data)
+	s, ok := tp.subs[c]
+	if msgtype != kdb.SYNC || !ok {
+		return res, err
+	}
+	if err != nil {
+		res = kdb.Error(err)
+	} else if res == nil {
+		res = &kdb.K{Type: kdb.KFUNCUP, Attr: kdb.NONE, Data: byte(0)}
+	}
+	tp.enqueue(s, message{kdb.RESPONSE, res})
+	return nil, kdb.ErrDeferred
+}
+
+// call dispatches request, must be called with tp.mu held
+func (tp *Tickerplant) call(ctx context.Context, c *kdb.ServerConn, data *kdb.K) (*kdb.K, error) {
+	name, args := parseCall(data)
+	switch name {
+	case ".u.sub":
+		if len(args) != 2 {
+			return nil, errors.New("rank")
+		}
+		return tp.subscribe(ctx, c, args[0], args[1])
+	case ".u.upd", "upd":
+		if len(args) != 2 || args[0].Type != -kdb.KS {
+			return nil, errors.New("rank")
+		}
+		return nil, tp.publish(args[0].Data.(string), args[1])
+	case ".u.t":
+		return kdb.SymbolV(tp.tables()), nil
+	case ".u.i":
+		return kdb.Long(tp.count()), nil
+	case ".u.L":
+		if tp.Journal == nil {
+			return kdb.Symbol(""), nil
+		}
+		return kdb.Symbol(":" + tp.Journal.Name()), nil
+	}
+	return nil, errors.New("Unsupported request " + name)
+}
+
+// parseCall splits (`name;args...) or "name" into function name and arguments
+func parseCall(data *kdb.K) (string, []*kdb.K) {
+	switch data.Type {
+	case -kdb.KS, kdb.KC:
+		return data.Data.(string), nil
+	case kdb.K0:
+		list := data.Data.([]*kdb.K)
+		if len(list) > 0 && (list[0].Type == -kdb.KS || list[0].Type == kdb.KC) {
+			return list[0].Data.(string), list[1:]
+		}
+	}
+	return "", nil
+}
+
+// subscribe registers c for updates of table (` for all) filtered by syms (` for all)
+// and returns (table;schema) or list of those for all tables, must be called with tp.mu held
+func (tp *Tickerplant) subscribe(ctx context.Context, c *kdb.ServerConn, table, syms *kdb.K) (*kdb.K, error) {
+	if table.Type != -kdb.KS {
+		return nil, errors.New("type")
+	}
+	var filter map[string]bool
+	switch syms.Type {
+	case -kdb.KS:
+		if s := syms.Data.(string); s != "" {
+			filter = map[string]bool{s: true}
+		}
+	case kdb.KS:
+		filter = make(map[string]bool)
+		for _, s := range syms.Data.([]string) {
+			filter[s] = true
+		}
+	default:
+		return nil, errors.New("type")
+	}
+	names := []string{table.Data.(string)}
+	if names[0] == "" {
+		names = tp.tables()
+	}
+	res := make([]*kdb.K, len(names))
+	for i, name := range names {
+		schema, ok := tp.schemas[name]
+		if !ok {
+			// tick.q signals unknown table by its name
+			return nil, errors.New(name)
+		}
+		res[i] = kdb.NewList(kdb.Symbol(name), &kdb.K{Type: kdb.XT, Attr: kdb.NONE, Data: schema})
+	}
+	s, ok := tp.subs[c]
+	if !ok {
+		s = &subscriber{conn: c, tables: make(map[string]map[string]bool), queue: make(chan message, tp.queueSize())}
+		if tp.subs == nil {
+			tp.subs = make(map[*kdb.ServerConn]*subscriber)
+		}
+		tp.subs[c] = s
+		go tp.send(s)
+		go func() {
+			<-ctx.Done()
+			tp.mu.Lock()
+			defer tp.mu.Unlock()
+			tp.remove(s)
+		}()
+	}
+	for _, name := range names {
+		s.tables[name] = filter
+	}
+	if table.Data.(string) != "" {
+		return res[0], nil
+	}
+	return kdb.NewList(res...), nil
+}
+
+func (tp *Tickerplant) queueSize() int {
+	if tp.QueueSize > 0 {
+		return tp.QueueSize
+	}
+	return DefaultQueueSize
+}
+
+// send writes queued messages to subscriber until it is removed
+func (tp *Tickerplant) send(s *subscriber) {
+	for msg := range s.queue {
+		if err := s.conn.WriteMessage(msg.msgtype, msg.data); err != nil {
+			tp.logf("kdb: failed to publish to %v: %v", s.conn.RemoteAddr(), err)
+			s.conn.Close()
+			tp.mu.Lock()
+			tp.remove(s)
+			tp.mu.Unlock()
+			// drain remaining messages so that publishing never blocks
+			for range s.queue {
+			}
+			return
+		}
+	}
+}
+
+// remove unsubscribes s, must be called with tp.mu held
+func (tp *Tickerplant) remove(s *subscriber) {
+	if tp.subs[s.conn] == s {
+		delete(tp.subs, s.conn)
+		close(s.queue)
+	}
+}
+
+// Publish sends update of table to subscribers.
+// data is a table, a list of column vectors or a list of atoms for a single row.
+func (tp *Tickerplant) Publish(table string, data *kdb.K) error {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	return tp.publish(table, data)
+}
+
+// publish is Publish with tp.mu held
+func (tp *Tickerplant) publish(table string, data *kdb.K) error {
+	schema, ok := tp.schemas[table]
+	if !ok {
+		return errors.New(table)
+	}
+	tbl, err := toTable(table, schema, data)
+	if err != nil {
+		return err
+	}
+	if tp.Journal != nil {
+		// tick.q logs columns rather than table
+		if err = tp.Journal.Upd(table, kdb.NewList(tbl.Data...)); err != nil {
+			return err
+		}
+	}
+	tp.i++
+	symcol := -1
+	for i, col := range tbl.Columns {
+		if col == "sym" && tbl.Data[i].Type == kdb.KS {
+			symcol = i
+		}
+	}
+	for _, s := range tp.subs {
+		filter, ok := s.tables[table]
+		if !ok {
+			continue
+		}
+		upd := tbl
+		if filter != nil && symcol >= 0 {
+			var rows []int
+			for i, sym := range tbl.Data[symcol].Data.([]string) {
+				if filter[sym] {
+					rows = append(rows, i)
+				}
+			}
+			if len(rows) == 0 {
+				continue
+			}
+			upd = selectRows(tbl, rows)
+		}
+		tp.enqueue(s, message{kdb.ASYNC, kdb.NewList(kdb.Symbol("upd"), kdb.Symbol(table), &kdb.K{Type: kdb.XT, Attr: kdb.NONE, Data: upd})})
+	}
+	return nil
+}
+
+// enqueue queues msg for s disconnecting it if the queue is full, must be called with tp.mu held
+func (tp *Tickerplant) enqueue(s *subscriber, msg message) {
+	select {
+	case s.queue <- msg:
+	default:
+		tp.logf("kdb: disconnecting slow subscriber %v", s.conn.RemoteAddr())
+		tp.remove(s)
+		s.conn.Close()
+	}
+}
+
+// count returns number of updates in the current journal, or published today if updates are not journaled
+func (tp *Tickerplant) count() int64 {
+	if tp.Journal != nil {
+		return tp.Journal.Count()
+	}
+	return tp.i
+}
+
+// EndOfDay calls .u.end[date] on all subscribers and switches to journal of the next day, like .u.endofday.
+// Current journal is closed. next can be nil if updates are not journaled.
+func (tp *Tickerplant) EndOfDay(date time.Time, next *journal.Journal) error {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	msg := message{kdb.ASYNC, kdb.NewList(kdb.Symbol(".u.end"), kdb.DateAtom(date))}
+	for _, s := range tp.subs {
+		tp.enqueue(s, msg)
+	}
+	var err error
+	if tp.Journal != nil {
+		err = tp.Journal.Close()
+	}
+	tp.Journal = next
+	tp.i = 0
+	return err
+}
+
+// toTable converts update of table name to table with columns of schema, adding time column if it is missing.
+// Columns must have types of schema columns, except general list columns which accept any type.
+func toTable(name string, schema kdb.Table, data *kdb.K) (kdb.Table, error) {
+	var cols []*kdb.K
+	switch data.Type {
+	case kdb.XT:
+		cols = data.Data.(kdb.Table).Data
+	case kdb.K0:
+		cols = data.Data.([]*kdb.K)
+	default:
+		return kdb.Table{}, errors.New("Update of " + name + " should be a table or list of columns")
+	}
+	if len(cols) > 0 && len(cols) == len(schema.Columns)-1 && schema.Data[0].Type == kdb.KN &&
+		cols[0].Type != kdb.KN && cols[0].Type != -kdb.KN {
+		cols = append([]*kdb.K{timeColumn(cols[0].Len())}, cols...)
+	}
+	if len(cols) != len(schema.Columns) {
+		return kdb.Table{}, errors.New("Update of " + name + " should have " + strconv.Itoa(len(schema.Columns)) + " columns")
+	}
+	res := kdb.Table{Columns: schema.Columns, Data: make([]*kdb.K, len(cols))}
+	for i, col := range cols {
+		if col.Type < 0 {
+			col = enlist(col)
+		}
+		if typ := schema.Data[i].Type; typ != kdb.K0 && col.Type != typ {
+			return kdb.Table{}, errors.New("Column " + schema.Columns[i] + " of " + name + " should have type " +
+				strconv.Itoa(int(typ)) + ", got " + strconv.Itoa(int(col.Type)))
+		}
+		if col.Len() != cols[0].Len() {
+			return kdb.Table{}, errors.New("Column " + schema.Columns[i] + " of " + name + " should have " +
+				strconv.Itoa(cols[0].Len()) + " rows, got " + strconv.Itoa(col.Len()))
+		}
+		res.Data[i] = col
+	}
+	return res, nil
+}
+
+// timeColumn returns n copies of current time of day
+func timeColumn(n int) *kdb.K {
+	now := time.Now()
+	since := now.Sub(time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location()))
+	v := make([]kdb.Timespan, n)
+	for i := range v {
+		v[i] = kdb.Timespan(since)
+	}
+	return &kdb.K{Type: kdb.KN, Attr: kdb.NONE, Data: v}
+}
+
+// enlist converts atom to vector of length 1
+func enlist(atom *kdb.K) *kdb.K {
+	if atom.Type == -kdb.KC {
+		return &kdb.K{Type: kdb.KC, Attr: kdb.NONE, Data: string([]byte{atom.Data.(byte)})}
+	}
+	v := reflect.ValueOf(atom.Data)
+	s := reflect.MakeSlice(reflect.SliceOf(v.Type()), 1, 1)
+	s.Index(0).Set(v)
+	return &kdb.K{Type: -atom.Type, Attr: kdb.NONE, Data: s.Interface()}
+}
+
+// selectRows returns rows of tbl at given indices
+func selectRows(tbl kdb.Table, rows []int) kdb.Table {
+	res := kdb.Table{Columns: tbl.Columns, Data: make([]*kdb.K, len(tbl.Data))}
+	for i, col := range tbl.Data {
+		if col.Type == kdb.KC {
+			s := col.Data.(string)
+			b := make([]byte, len(rows))
+			for j, r := range rows {
+				b[j] = s[r]
+			}
+			res.Data[i] = &kdb.K{Type: kdb.KC, Attr: kdb.NONE, Data: string(b)}
+			continue
+		}
+		v := reflect.ValueOf(col.Data)
+		s := reflect.MakeSlice(v.Type(), len(rows), len(rows))
+		for j, r := range rows {
+			s.Index(j).Set(v.Index(r))
+		}
+		res.Data[i] = &kdb.K{Type: col.Type, Attr: kdb.NONE, Data: s.Interface()}
+	}
+	return res
+}
+
+func (tp *Tickerplant) logf(format string, args ...interface{}) {
+	if tp.ErrorLog != nil {
+		tp.ErrorLog.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
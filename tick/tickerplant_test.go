@@ -0,0 +1,217 @@
+package tick
+
+import (
+	"io"
+	"log"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sv/kdbgo"
+)
+
+func tradeSchema() *kdb.K {
+	return kdb.NewTable([]string{"time", "sym", "price", "size"}, []*kdb.K{
+		{Type: kdb.KN, Attr: kdb.NONE, Data: []time.Duration{}},
+		kdb.SymbolV([]string{}),
+		kdb.FloatV([]float64{}),
+		kdb.LongV([]int64{}),
+	})
+}
+
+// startTickerplant serves tp on random port
+func startTickerplant(t *testing.T, tp *Tickerplant) int {
+	if err := tp.AddTable("trade", tradeSchema()); err != nil {
+		t.Fatal("Failed to add table:", err)
+	}
+	tp.ErrorLog = log.New(io.Discard, "", 0)
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal("Failed to listen:", err)
+	}
+	s := &kdb.Server{Handler: tp, ErrorLog: tp.ErrorLog}
+	go s.Serve(ln)
+	t.Cleanup(func() { s.Close() })
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+func TestTickerplant(t *testing.T) {
+	port := startTickerplant(t, New())
+	sub, err := kdb.DialKDB("localhost", port, "")
+	if err != nil {
+		t.Fatal("Failed to connect:", err)
+	}
+	defer sub.Close()
+	res, err := sub.Call(".u.sub", kdb.Symbol("trade"), kdb.SymbolV([]string{"AAPL"}))
+	if err != nil {
+		t.Fatal("Subscription failed:", err)
+	}
+	schema := res.Data.([]*kdb.K)
+	if schema[0].Data.(string) != "trade" || schema[1].Type != kdb.XT || len(schema[1].Data.(kdb.Table).Columns) != 4 {
+		t.Error("Unexpected subscription result", res)
+	}
+	feed, err := kdb.DialKDB("localhost", port, "")
+	if err != nil {
+		t.Fatal("Failed to connect:", err)
+	}
+	defer feed.Close()
+	err = feed.AsyncCall(".u.upd", kdb.Symbol("trade"), kdb.NewList(
+		kdb.SymbolV([]string{"MSFT", "AAPL"}), kdb.FloatV([]float64{1, 2}), kdb.LongV([]int64{10, 20})))
+	if err != nil {
+		t.Fatal("Publishing failed:", err)
+	}
+	err = feed.AsyncCall(".u.upd", kdb.Symbol("trade"), kdb.NewList(kdb.Symbol("AAPL"), kdb.Float(3), kdb.Long(30)))
+	if err != nil {
+		t.Fatal("Publishing failed:", err)
+	}
+	for _, expected := range []float64{2, 3} {
+		msg, msgtype, err := sub.ReadMessage()
+		if err != nil || msgtype != kdb.ASYNC {
+			t.Fatal("Failed to receive update:", err)
+		}
+		upd := msg.Data.([]*kdb.K)
+		if upd[0].Data.(string) != "upd" || upd[1].Data.(string) != "trade" {
+			t.Fatal("Unexpected update", msg)
+		}
+		tbl := upd[2].Data.(kdb.Table)
+		if tbl.Data[0].Type != kdb.KN || tbl.Data[1].Len() != 1 || tbl.Data[1].Data.([]string)[0] != "AAPL" {
+			t.Error("Update was not filtered or timestamped", tbl)
+		}
+		if price := tbl.Data[2].Data.([]float64)[0]; price != expected {
+			t.Errorf("Expected price %v, got %v", expected, price)
+		}
+	}
+	res, err = feed.Call(".u.i")
+	if err != nil || res.Data.(int64) != 2 {
+		t.Error("Unexpected message count", res, err)
+	}
+	if _, err = feed.Call(".u.sub", kdb.Symbol("quote"), kdb.Symbol("")); err == nil {
+		t.Error("Subscription to unknown table should fail")
+	}
+	if _, err = feed.Call(".u.upd", kdb.Symbol("trade"), kdb.NewList(kdb.Symbol("AAPL"))); err == nil {
+		t.Error("Update with missing columns should fail")
+	}
+}
+
+func TestTickerplantBadUpdate(t *testing.T) {
+	tp := New()
+	clock := kdb.NewTable([]string{"time"}, []*kdb.K{{Type: kdb.KN, Attr: kdb.NONE, Data: []time.Duration{}}})
+	if err := tp.AddTable("trade", tradeSchema()); err != nil {
+		t.Fatal(err)
+	}
+	if err := tp.AddTable("clock", clock); err != nil {
+		t.Fatal(err)
+	}
+	if err := tp.Publish("clock", kdb.NewList()); err == nil {
+		t.Error("Update without columns should fail")
+	}
+	err := tp.Publish("trade", kdb.NewList(kdb.SymbolV([]string{"AAPL"}), kdb.LongV([]int64{1}), kdb.LongV([]int64{10})))
+	if err == nil || !strings.Contains(err.Error(), "price") || !strings.Contains(err.Error(), "trade") {
+		t.Error("Expected type error for price column of trade, got", err)
+	}
+	err = tp.Publish("trade", kdb.NewList(kdb.SymbolV([]string{"AAPL"}), kdb.FloatV([]float64{1, 2}), kdb.LongV([]int64{10})))
+	if err == nil || !strings.Contains(err.Error(), "price") {
+		t.Error("Expected length error for price column, got", err)
+	}
+	if err = tp.Publish("trade", kdb.NewList(kdb.Symbol("AAPL"), kdb.Float(1), kdb.Long(10))); err != nil {
+		t.Error("Publishing failed:", err)
+	}
+}
+
+func TestTickerplantSubscribeAll(t *testing.T) {
+	port := startTickerplant(t, New())
+	sub, err := kdb.DialKDB("localhost", port, "")
+	if err != nil {
+		t.Fatal("Failed to connect:", err)
+	}
+	defer sub.Close()
+	res, err := sub.Call(".u.sub", kdb.Symbol(""), kdb.Symbol(""))
+	if err != nil {
+		t.Fatal("Subscription failed:", err)
+	}
+	if res.Len() != 1 || res.Data.([]*kdb.K)[0].Data.([]*kdb.K)[0].Data.(string) != "trade" {
+		t.Error("Unexpected subscription result", res)
+	}
+}
+
+func TestTickerplantSlowSubscriber(t *testing.T) {
+	tp := &Tickerplant{QueueSize: 1}
+	port := startTickerplant(t, tp)
+	sub, err := kdb.DialKDB("localhost", port, "")
+	if err != nil {
+		t.Fatal("Failed to connect:", err)
+	}
+	defer sub.Close()
+	if _, err = sub.Call(".u.sub", kdb.Symbol("trade"), kdb.Symbol("")); err != nil {
+		t.Fatal("Subscription failed:", err)
+	}
+	// subscriber does not read, publishing should not block
+	n := 1 << 17
+	data := kdb.NewList(kdb.SymbolV(make([]string, n)), kdb.FloatV(make([]float64, n)), kdb.LongV(make([]int64, n)))
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if err = tp.Publish("trade", data); err != nil {
+			t.Fatal("Publishing failed:", err)
+		}
+		tp.mu.Lock()
+		subscribed := len(tp.subs)
+		tp.mu.Unlock()
+		if subscribed == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Slow subscriber was not disconnected")
+		}
+	}
+}
+
+func TestTickerplantResponseOrder(t *testing.T) {
+	tp := New()
+	port := startTickerplant(t, tp)
+	sub, err := kdb.DialKDB("localhost", port, "")
+	if err != nil {
+		t.Fatal("Failed to connect:", err)
+	}
+	defer sub.Close()
+	if _, err = sub.Call(".u.sub", kdb.Symbol("trade"), kdb.Symbol("")); err != nil {
+		t.Fatal("Subscription failed:", err)
+	}
+	// fewer updates than QueueSize so that subscriber is not disconnected
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 5000; i++ {
+			tp.Publish("trade", trade("AAPL", 1))
+		}
+	}()
+	// every update counted by .u.i should be received before its response and no other
+	received := int64(0)
+	for finished := false; !finished; {
+		select {
+		case <-done:
+			finished = true
+		default:
+		}
+		if err = sub.WriteMessage(kdb.SYNC, &kdb.K{Type: kdb.KC, Attr: kdb.NONE, Data: ".u.i"}); err != nil {
+			t.Fatal(err)
+		}
+		for {
+			msg, msgtype, err := sub.ReadMessage()
+			if err != nil {
+				t.Fatal("Failed to receive message:", err)
+			}
+			if msgtype == kdb.ASYNC {
+				received++
+				continue
+			}
+			if n := msg.Data.(int64); n != received {
+				t.Fatalf("Received %v updates before .u.i response %v", received, n)
+			}
+			break
+		}
+	}
+	if received != 5000 {
+		t.Error("Expected 5000 updates, received", received)
+	}
+}
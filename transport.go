@@ -0,0 +1,64 @@
+package kdb
+
+import (
+	"context"
+	"io"
+	"net"
+	"time"
+)
+
+// NewConn performs q handshake over rwc and returns connection exchanging messages over it.
+// rwc can be any reliable stream, e.g. SSH channel, net.Pipe or a stream of a multiplexed connection.
+// Options controlling credentials, capability, handshake timeout, read buffer and compression apply.
+//
+// If rwc is not a net.Conn, pending I/O cannot be interrupted, so rwc is closed
+// once ctx of a call is done before the call completes.
+// Connection cannot be re-dialled by ReconnectingConn.
+func NewConn(ctx context.Context, rwc io.ReadWriteCloser, opts ...DialOption) (*KDBConn, error) {
+	cfg, err := newDialConfig(ctx, opts)
+	if err != nil {
+		rwc.Close()
+		return nil, err
+	}
+	hctx, cancel := cfg.handshakeContext(ctx)
+	defer cancel()
+	return handshake(hctx, streamConn(rwc), cfg)
+}
+
+// ServeStream serves q client connected over rwc, see ServeConn and NewConn
+func (s *Server) ServeStream(rwc io.ReadWriteCloser) {
+	s.ServeConn(streamConn(rwc))
+}
+
+// streamConn adapts rwc to net.Conn
+func streamConn(rwc io.ReadWriteCloser) net.Conn {
+	if conn, ok := rwc.(net.Conn); ok {
+		return conn
+	}
+	return &rwcConn{rwc}
+}
+
+// rwcConn is net.Conn without deadline support.
+// Deadline in the past, used to abort pending I/O, closes the stream.
+type rwcConn struct {
+	io.ReadWriteCloser
+}
+
+// streamAddr is address of a stream which is not a network connection
+type streamAddr struct{}
+
+func (streamAddr) Network() string { return "stream" }
+func (streamAddr) String() string  { return "stream" }
+
+func (c *rwcConn) LocalAddr() net.Addr  { return streamAddr{} }
+func (c *rwcConn) RemoteAddr() net.Addr { return streamAddr{} }
+
+func (c *rwcConn) SetDeadline(t time.Time) error {
+	if !t.IsZero() && t.Before(time.Now()) {
+		return c.Close()
+	}
+	return nil
+}
+
+func (c *rwcConn) SetReadDeadline(t time.Time) error  { return c.SetDeadline(t) }
+func (c *rwcConn) SetWriteDeadline(t time.Time) error { return c.SetDeadline(t) }
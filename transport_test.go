@@ -0,0 +1,69 @@
+package kdb
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"testing"
+	"time"
+)
+
+// pipe returns connected streams without deadline support
+func pipe() (io.ReadWriteCloser, io.ReadWriteCloser) {
+	c1, c2 := net.Pipe()
+	return struct{ io.ReadWriteCloser }{c1}, struct{ io.ReadWriteCloser }{c2}
+}
+
+func TestNewConn(t *testing.T) {
+	client, server := pipe()
+	release := make(chan struct{})
+	s := &Server{
+		Handler: HandlerFunc(func(ctx context.Context, c *ServerConn, msgtype ReqType, data *K) (*K, error) {
+			args := data.Data.([]*K)
+			if args[0].Data.(string) == "wait" {
+				<-release
+			}
+			return args[1], nil
+		}),
+		ErrorLog: log.New(io.Discard, "", 0),
+	}
+	go s.ServeStream(server)
+	defer close(release)
+	con, err := NewConn(context.Background(), client, WithAuth("user:pwd"), WithCapability(CapabilityV30))
+	if err != nil {
+		t.Fatal("Handshake failed:", err)
+	}
+	defer con.Close()
+	if con.Capability() != CapabilityV30 {
+		t.Error("Unexpected capability", con.Capability())
+	}
+	res, err := con.Call("echo", Long(42))
+	if err != nil || res.Data.(int64) != 42 {
+		t.Error("Call over stream failed", res, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err = con.CallContext(ctx, "wait", Long(1)); err != context.DeadlineExceeded {
+		t.Error("Expected deadline error, got", err)
+	}
+	if _, err = con.Call("echo", Long(1)); err == nil {
+		t.Error("Stream should be closed after cancelled call")
+	}
+	if _, err = NewReconnectingConn(con); err == nil {
+		t.Error("Connection over stream should not be re-dialled")
+	}
+}
+
+func TestNewConnHandshakeTimeout(t *testing.T) {
+	client, server := pipe()
+	defer server.Close()
+	start := time.Now()
+	_, err := NewConn(context.Background(), client, WithHandshakeTimeout(50*time.Millisecond))
+	if err != context.DeadlineExceeded {
+		t.Error("Expected deadline error, got", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Error("Handshake timeout was not applied, handshake took", d)
+	}
+}
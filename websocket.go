@@ -0,0 +1,394 @@
+package kdb
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WebSocket opcodes, RFC 6455 section 5.2
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+)
+
+// wsGUID is appended to the key to compute Sec-WebSocket-Accept
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// ErrWebSocketHandshake indicates that HTTP upgrade to WebSocket failed
+var ErrWebSocketHandshake = errors.New("WebSocket handshake failed")
+
+// wsCloseTimeout limits time spent sending close frame to unresponsive peer
+const wsCloseTimeout = time.Second
+
+// wsCapability is assumed for WebSocket peers as there is no q handshake to negotiate it
+const wsCapability = CapabilityV30
+
+// DialWebSocket connects to q process accepting WebSocket connections at ws:// or wss:// URL s.
+// Each q IPC message is exchanged as a single binary frame. There is no q handshake,
+// credentials are sent using HTTP basic authentication. Messages are not compressed
+// unless WithCompression is given, as browser clients usually do not support it.
+func DialWebSocket(ctx context.Context, s string, opts ...DialOption) (*KDBConn, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := newDialConfig(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), map[string]string{"ws": "80", "wss": "443"}[u.Scheme])
+	}
+	switch u.Scheme {
+	case "ws":
+	case "wss":
+		if cfg.tls == nil {
+			cfg.tls = &tls.Config{}
+		}
+	default:
+		return nil, errors.New("Unsupported URL scheme " + u.Scheme)
+	}
+
+	dctx := ctx
+	if cfg.connectTimeout > 0 {
+		var cancel context.CancelFunc
+		dctx, cancel = context.WithTimeout(ctx, cfg.connectTimeout)
+		defer cancel()
+	}
+	d := net.Dialer{KeepAlive: cfg.keepAlive}
+	conn, err := d.DialContext(dctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	hctx, cancel := cfg.handshakeContext(ctx)
+	defer cancel()
+	if cfg.tls != nil {
+		tcfg := cfg.tls
+		if tcfg.ServerName == "" {
+			tcfg = tcfg.Clone()
+			tcfg.ServerName = u.Hostname()
+		}
+		tc := tls.Client(conn, tcfg)
+		if err = tc.HandshakeContext(hctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tc
+	}
+	c := &KDBConn{
+		Host:       u.Hostname(),
+		Port:       u.Port(),
+		userpwd:    cfg.auth,
+		capability: wsCapability,
+		compress:   cfg.compress,
+		stats:      cfg.stats,
+		rsem:       make(chan struct{}, 1),
+	}
+	if c.compress == nil {
+		c.compress = CompressNever
+	}
+	if cfg.capability < c.capability {
+		c.capability = cfg.capability
+	}
+	c.con = conn
+	stop := c.watch(hctx, conn.SetDeadline)
+	ws, err := wsClientHandshake(conn, u, cfg.auth)
+	if err = stop(err); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	c.con = ws
+	if cfg.readBufferSize > 0 {
+		c.rbuf = bufio.NewReaderSize(ws, cfg.readBufferSize)
+	} else {
+		c.rbuf = bufio.NewReader(ws)
+	}
+	c.redial = func(ctx context.Context) (*KDBConn, error) {
+		return DialWebSocket(ctx, s, opts...)
+	}
+	return c, nil
+}
+
+// wsClientHandshake upgrades HTTP connection to WebSocket
+func wsClientHandshake(conn net.Conn, u *url.URL, auth string) (*wsConn, error) {
+	var nonce [16]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+	path := u.RequestURI()
+	req, err := http.NewRequest("GET", "http://"+u.Host+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	if auth != "" {
+		req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(auth)))
+	}
+	if err = req.Write(conn); err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return nil, ErrAuthFailed
+	case resp.StatusCode != http.StatusSwitchingProtocols,
+		!strings.EqualFold(resp.Header.Get("Upgrade"), "websocket"),
+		resp.Header.Get("Sec-WebSocket-Accept") != wsAccept(key):
+		return nil, ErrWebSocketHandshake
+	}
+	return &wsConn{Conn: conn, r: r, client: true}, nil
+}
+
+// wsAccept computes Sec-WebSocket-Accept for key
+func wsAccept(key string) string {
+	h := sha1.Sum([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// WebSocketHandler returns http.Handler accepting q clients over WebSocket, e.g. browsers using c.js.
+// Clients are authenticated by Authenticator using HTTP basic authentication.
+// Messages are served by Handler the same way as for connections accepted by Serve.
+func (s *Server) WebSocketHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, _ := r.BasicAuth()
+		if s.Authenticator != nil {
+			if err := s.Authenticator.Authenticate(r.Context(), user, password); err != nil {
+				w.Header().Set("WWW-Authenticate", `Basic realm="kdb"`)
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		key := r.Header.Get("Sec-WebSocket-Key")
+		if r.Method != "GET" || !headerHasToken(r.Header, "Connection", "upgrade") ||
+			!headerHasToken(r.Header, "Upgrade", "websocket") ||
+			r.Header.Get("Sec-WebSocket-Version") != "13" || key == "" {
+			http.Error(w, "Bad WebSocket handshake", http.StatusBadRequest)
+			return
+		}
+		hj, ok := w.(http.Hijacker)
+		if !ok {
+			http.Error(w, "WebSocket is not supported", http.StatusInternalServerError)
+			return
+		}
+		conn, brw, err := hj.Hijack()
+		if err != nil {
+			s.logf("kdb: WebSocket upgrade failed: %v", err)
+			return
+		}
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n")
+		brw.WriteString("Sec-WebSocket-Accept: " + wsAccept(key) + "\r\n\r\n")
+		if err = brw.Flush(); err != nil {
+			conn.Close()
+			return
+		}
+		ws := &wsConn{Conn: conn, r: brw.Reader}
+		defer ws.Close()
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		s.serve(ctx, &ServerConn{
+			conn:       ws,
+			rbuf:       bufio.NewReader(ws),
+			user:       user,
+			capability: wsCapability,
+			compress:   CompressNever,
+			stats:      s.CompressionStats,
+		})
+	})
+}
+
+// headerHasToken reports whether comma separated header contains token
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// wsConn exchanges stream of bytes as WebSocket binary frames.
+// Every Write is sent as a single frame, payloads of received frames are concatenated.
+type wsConn struct {
+	net.Conn
+	r *bufio.Reader
+	// client masks outgoing frames
+	client bool
+
+	wmu sync.Mutex // serialises frames
+	// state of the frame being read
+	remaining int64
+	mask      [4]byte
+	masked    bool
+	pos       int
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	for c.remaining == 0 {
+		if err := c.nextFrame(); err != nil {
+			return 0, err
+		}
+	}
+	if int64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.r.Read(p)
+	if c.masked {
+		for i := 0; i < n; i++ {
+			p[i] ^= c.mask[c.pos&3]
+			c.pos++
+		}
+	}
+	c.remaining -= int64(n)
+	return n, err
+}
+
+// nextFrame reads header of the next data frame handling control frames in between
+func (c *wsConn) nextFrame() error {
+	var h [2]byte
+	if _, err := io.ReadFull(c.r, h[:]); err != nil {
+		return err
+	}
+	opcode := h[0] & 0x0f
+	c.masked = h[1]&0x80 != 0
+	size := int64(h[1] & 0x7f)
+	switch size {
+	case 126:
+		var n uint16
+		if err := binary.Read(c.r, binary.BigEndian, &n); err != nil {
+			return err
+		}
+		size = int64(n)
+	case 127:
+		var n uint64
+		if err := binary.Read(c.r, binary.BigEndian, &n); err != nil {
+			return err
+		}
+		size = int64(n)
+		if size < 0 {
+			return ErrBadMsg
+		}
+	}
+	if c.masked == c.client {
+		// clients must mask frames and servers must not, RFC 6455 section 5.1
+		c.writeFrame(wsClose, []byte{0x03, 0xea}) // 1002 protocol error
+		return ErrBadMsg
+	}
+	if c.masked {
+		if _, err := io.ReadFull(c.r, c.mask[:]); err != nil {
+			return err
+		}
+	}
+	c.pos = 0
+	switch opcode {
+	case wsBinary, wsContinuation:
+		c.remaining = size
+		return nil
+	case wsClose, wsPing, wsPong:
+		if size > 125 {
+			return ErrBadMsg
+		}
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(c.r, payload); err != nil {
+			return err
+		}
+		if c.masked {
+			for i := range payload {
+				payload[i] ^= c.mask[i&3]
+			}
+		}
+		switch opcode {
+		case wsClose:
+			c.writeFrame(wsClose, payload)
+			return io.EOF
+		case wsPing:
+			return c.writeFrame(wsPong, payload)
+		}
+		return nil
+	}
+	// text frames are not q IPC messages
+	c.writeFrame(wsClose, []byte{0x03, 0xeb}) // 1003 unsupported data
+	return ErrBadMsg
+}
+
+func (c *wsConn) Write(p []byte) (int, error) {
+	if err := c.writeFrame(wsBinary, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// writeFrame sends payload as a single final frame
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	var buf []byte
+	buf = append(buf, 0x80|opcode)
+	var maskBit byte
+	if c.client {
+		maskBit = 0x80
+	}
+	switch n := len(payload); {
+	case n < 126:
+		buf = append(buf, maskBit|byte(n))
+	case n <= 0xffff:
+		buf = append(buf, maskBit|126, byte(n>>8), byte(n))
+	default:
+		buf = append(buf, maskBit|127)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(n))
+	}
+	if c.client {
+		var mask [4]byte
+		if _, err := rand.Read(mask[:]); err != nil {
+			return err
+		}
+		buf = append(buf, mask[:]...)
+		start := len(buf)
+		buf = append(buf, payload...)
+		for i := range buf[start:] {
+			buf[start+i] ^= mask[i&3]
+		}
+	} else {
+		buf = append(buf, payload...)
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	_, err := c.Conn.Write(buf)
+	return err
+}
+
+// Close sends close frame unless a write is in progress and closes the connection
+func (c *wsConn) Close() error {
+	if c.wmu.TryLock() {
+		c.wmu.Unlock()
+		c.Conn.SetWriteDeadline(time.Now().Add(wsCloseTimeout))
+		c.writeFrame(wsClose, []byte{0x03, 0xe8}) // 1000 normal closure
+	}
+	return c.Conn.Close()
+}
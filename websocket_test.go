@@ -0,0 +1,107 @@
+package kdb
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"log"
+	"net"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func webSocketServer(t *testing.T, tlsServer bool) (*Server, string) {
+	async := make(chan *K, 1)
+	s := &Server{
+		Handler: echoHandler(async),
+		Authenticator: AuthenticatorFunc(func(ctx context.Context, user, password string) error {
+			if user != "user" || password != "pwd" {
+				return ErrAuthFailed
+			}
+			return nil
+		}),
+		ErrorLog: log.New(io.Discard, "", 0),
+	}
+	var hs *httptest.Server
+	if tlsServer {
+		hs = httptest.NewTLSServer(s.WebSocketHandler())
+	} else {
+		hs = httptest.NewServer(s.WebSocketHandler())
+	}
+	t.Cleanup(func() {
+		s.Close()
+		hs.Close()
+	})
+	return s, "ws" + strings.TrimPrefix(hs.URL, "http")
+}
+
+func TestWebSocket(t *testing.T) {
+	_, url := webSocketServer(t, false)
+	con, err := DialWebSocket(context.Background(), url+"/", WithAuth("user:pwd"))
+	if err != nil {
+		t.Fatal("Failed to connect:", err)
+	}
+	defer con.Close()
+	for _, n := range []int{1, 100, 10000} {
+		res, err := con.Call("echo", LongV(make([]int64, n)))
+		if err != nil || res.Len() != n {
+			t.Errorf("Echo of %d longs failed: %v", n, err)
+		}
+	}
+	if _, err = con.Call("fail", Long(1)); err != QError("failed") {
+		t.Error("Expected handler error, got", err)
+	}
+	if _, err = DialWebSocket(context.Background(), url, WithAuth("user:wrong")); err != ErrAuthFailed {
+		t.Error("Expected authentication failure, got", err)
+	}
+}
+
+func TestWebSocketUnmasked(t *testing.T) {
+	_, s := webSocketServer(t, false)
+	u, err := url.Parse(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", u.Host)
+	if err != nil {
+		t.Fatal("Failed to connect:", err)
+	}
+	defer conn.Close()
+	ws, err := wsClientHandshake(conn, u, "user:pwd")
+	if err != nil {
+		t.Fatal("Handshake failed:", err)
+	}
+	// client sending unmasked frames violates the protocol
+	ws.client = false
+	b, _ := Encoder{}.Marshal(SYNC, NewList(Symbol("echo"), Long(1)))
+	if _, err = ws.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	var frame [4]byte
+	if _, err = io.ReadFull(ws.r, frame[:]); err != nil || frame != [4]byte{0x88, 2, 0x03, 0xea} {
+		t.Errorf("Expected close frame with status 1002, got %x, %v", frame, err)
+	}
+}
+
+func TestWebSocketTLS(t *testing.T) {
+	_, url := webSocketServer(t, true)
+	con, err := DialWebSocket(context.Background(), url, WithAuth("user:pwd"), WithTLS(&tls.Config{InsecureSkipVerify: true}))
+	if err != nil {
+		t.Fatal("Failed to connect:", err)
+	}
+	defer con.Close()
+	if res, err := con.Call("echo", Symbol("a")); err != nil || res.Data.(string) != "a" {
+		t.Error("Call over wss failed", res, err)
+	}
+}
+
+func TestWebSocketHandshakeRejected(t *testing.T) {
+	// plain HTTP server does not upgrade
+	hs := httptest.NewServer(nil)
+	defer hs.Close()
+	if _, err := DialWebSocket(context.Background(), "ws"+strings.TrimPrefix(hs.URL, "http")); err != ErrWebSocketHandshake {
+		t.Error("Expected handshake failure, got", err)
+	}
+}